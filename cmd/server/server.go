@@ -4,17 +4,27 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"os"
+	"strings"
+	"time"
 
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/recover"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 
 	"log/slog"
 
 	"github.com/patrickfnielsen/pdp-client/internal/config"
 	"github.com/patrickfnielsen/pdp-client/internal/handlers"
+	"github.com/patrickfnielsen/pdp-client/internal/rpc"
 	"github.com/patrickfnielsen/pdp-client/internal/util"
 	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+	pdpv1 "github.com/patrickfnielsen/pdp-client/proto/pdp/v1"
 )
 
 func main() {
@@ -34,46 +44,57 @@ func main() {
 	defer cancelCtx()
 
 	// setup the permit client
+	destinations, err := logDestinations()
+	if err != nil {
+		logger.Error("invalid decision log destinations", slog.String("error", err.Error()))
+		panic(err)
+	}
+
+	environments, err := config.Environments()
+	if err != nil {
+		logger.Error("invalid environments", slog.String("error", err.Error()))
+		panic(err)
+	}
+
+	environmentNames := make([]string, 0, len(environments))
+	for _, env := range environments {
+		environmentNames = append(environmentNames, env.Name)
+	}
+
 	permit, err := pdp.New(&pdp.PermitConfig{
 		Logger: pdp.DecisionLogConfig{
-			ConsoleLog:      config.PolicyServerLogConsole,
-			HTTPLog:         config.PolicyServerLogHTTP,
-			Endpoint:        util.FormatURL(config.PolicyLogServer, config.PolicyLogServerEndpoint, config.PolicyLogServerTLS),
-			EndpointTimeout: 5,
-			BearerToken:     config.PolicyLogServerToken,
+			ConsoleLog:   config.PolicyServerLogConsole,
+			HTTPLog:      config.PolicyServerLogHTTP,
+			Destinations: destinations,
 		},
+		Environments: environmentNames,
 	})
 	if err != nil {
-		logger.Error("failed to start permit client", err)
+		logger.Error("failed to start permit client", slog.String("error", err.Error()))
 		panic(err)
 	}
 
-	// setup policy updater
-	updater := pdp.NewPolicyUpdater(
-		config.PolicyRepository,
-		config.PolicyRepositoryKey,
-		config.PolicyRepositoryBranch,
-		func(ctx context.Context, b []pdp.PolicyBundle) {
-			for i := 0; i < len(b); i++ {
-				slog.Info("policy update", slog.String("name", b[i].Name))
-
-				err := permit.Activate(ctx, b[i].Name, string(b[i].Data))
-				if err != nil {
-					slog.Error("failed to activate policy", slog.String("error", err.Error()))
-					return
-				}
-			}
-		},
-	)
-
-	// sync the initial policies, and then start a periodic sync afterwards
-	err = updater.RunUpdate(ctx)
+	// setup policy updater, with a composer per environment
+	composer, err := policyComposer(ctx, permit, nil)
 	if err != nil {
-		logger.Error("failed sync permissions", err)
+		logger.Error("failed to setup policies", slog.String("error", err.Error()))
 		panic(err)
 	}
 
-	go updater.Start(ctx)
+	environmentComposers := make(map[string]*pdp.PolicyComposer, len(environments))
+	for i := range environments {
+		env := &environments[i]
+		environmentComposers[env.Name], err = policyComposer(ctx, permit, env)
+		if err != nil {
+			logger.Error("failed to setup policies", slog.String("environment", env.Name), slog.String("error", err.Error()))
+			panic(err)
+		}
+	}
+
+	go composer.Start(ctx)
+	for _, c := range environmentComposers {
+		go c.Start(ctx)
+	}
 
 	// setup fiber + routes
 	app := fiber.New(fiber.Config{
@@ -84,6 +105,38 @@ func main() {
 	})
 	app.Use(recover.New())
 
+	// register the kubernetes probes
+	HealthRoutes := handlers.HealthRoutes{
+		Permit:       permit,
+		Composer:     composer,
+		Environments: environmentComposers,
+		MaxStaleness: time.Duration(config.HealthMaxStaleness) * time.Second,
+	}
+
+	app.Get("/health/live", HealthRoutes.Live)
+	app.Get("/health/ready", HealthRoutes.Ready)
+
+	// register the prometheus metrics
+	MetricsRoutes := handlers.MetricsRoutes{
+		Composer:     composer,
+		Environments: environmentComposers,
+	}
+
+	app.Get("/metrics", MetricsRoutes.Handler())
+
+	// register the OPA compatible data api
+	DataRoutes := handlers.DataRoutes{
+		Permit:       permit,
+		Composer:     composer,
+		Environments: environmentComposers,
+		Version:      fmt.Sprintf("%f", config.VERSION),
+	}
+
+	app.Get("/v1/data", DataRoutes.Get)
+	app.Get("/v1/data/*", DataRoutes.Get)
+	app.Post("/v1/data", DataRoutes.Post)
+	app.Post("/v1/data/*", DataRoutes.Post)
+
 	// register pdp routes
 	PdpRoutes := handlers.PdpRoutes{
 		Permit: permit,
@@ -91,6 +144,68 @@ func main() {
 
 	route := app.Group("/api/v1")
 	route.Post("/pdp/decision", PdpRoutes.PdpCheck)
+	route.Get("/pdp/logs/status", PdpRoutes.LoggerStatus)
+	route.Get("/pdp/logs/deadletter", PdpRoutes.DeadLetters)
+	route.Post("/pdp/logs/deadletter/replay", PdpRoutes.ReplayDeadLetters)
+
+	// register policy routes
+	PolicyRoutes := handlers.PolicyRoutes{
+		Composer:     composer,
+		Environments: environmentComposers,
+	}
+
+	route.Get("/status", PolicyRoutes.Status)
+	route.Get("/pdp/policies/revision", PolicyRoutes.Revision)
+	route.Get("/pdp/policies/signature", PolicyRoutes.SignatureStatus)
+
+	// register the time travel route, each environment has its own history
+	HistoryRoutes := handlers.HistoryRoutes{
+		TimeTravel:   pdp.NewTimeTravel(composer, config.PolicyHistoryCacheSize),
+		Environments: make(map[string]*pdp.TimeTravel, len(environmentComposers)),
+	}
+	for name, c := range environmentComposers {
+		HistoryRoutes.Environments[name] = pdp.NewTimeTravel(c, config.PolicyHistoryCacheSize)
+	}
+
+	route.Post("/pdp/policies/history/decision", HistoryRoutes.Decision)
+
+	// register the kubernetes admission webhook
+	AdmissionRoutes := handlers.AdmissionRoutes{
+		Permit:       permit,
+		Composer:     composer,
+		Environments: environmentComposers,
+		Path:         config.AdmissionPath,
+	}
+
+	route.Post("/pdp/admission", AdmissionRoutes.Review)
+
+	// register the git webhook, only when a secret is configured as we can't
+	// verify requests without one
+	if config.PolicyWebhookSecret != "" {
+		WebhookRoutes := handlers.WebhookRoutes{
+			Composer:     composer,
+			Environments: environmentComposers,
+			Secret:       config.PolicyWebhookSecret,
+		}
+
+		route.Post("/webhooks/git", WebhookRoutes.GitPush)
+	}
+
+	// start the grpc server alongside fiber
+	var grpcServer *grpc.Server
+	var decisionService *rpc.DecisionService
+	if config.GrpcAddress != "" {
+		decisionService = rpc.NewDecisionService(permit, composer, environmentComposers)
+		grpcServer, err = startGrpcServer(
+			config.GrpcAddress,
+			decisionService,
+			rpc.NewAuthorizationService(permit, config.EnvoyAuthorizationPath),
+		)
+		if err != nil {
+			logger.Error("failed to start grpc server", slog.String("error", err.Error()))
+			panic(err)
+		}
+	}
 
 	// listen for system interrupts like ctrl+c
 	quit := make(chan struct{})
@@ -101,10 +216,19 @@ func main() {
 
 		//shutdown down services gracefully
 		logger.Info("service shutting down")
+		if grpcServer != nil {
+			// end the revision watches first, as a graceful stop waits for them
+			decisionService.Stop()
+			grpcServer.GracefulStop()
+		}
+		composer.Stop()
+		for _, c := range environmentComposers {
+			c.Stop()
+		}
 		err := permit.Close(ctx)
 		err = errors.Join(app.Shutdown(), err)
 		if err != nil {
-			logger.Error("Service shutdown with errors", err)
+			logger.Error("Service shutdown with errors", slog.String("error", err.Error()))
 		}
 
 		// cancel the context and anything waiting for it
@@ -119,10 +243,371 @@ func main() {
 	// start the app and handles errors
 	err = app.Listen(":3000")
 	if err != nil {
-		logger.Error("service exited in a non-standard way", err)
+		logger.Error("service exited in a non-standard way", slog.String("error", err.Error()))
 		cleanup()
 	}
 
 	// wait for shutdown
 	<-quit
 }
+
+// startGrpcServer serves the decision service, the Envoy authorization
+// service, health checks and reflection on the address. The policies are
+// loaded before it's started, so it reports itself as serving right away.
+func startGrpcServer(address string, decisions *rpc.DecisionService, authorization *rpc.AuthorizationService) (*grpc.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	server := grpc.NewServer()
+	pdpv1.RegisterDecisionServiceServer(server, decisions)
+	authv3.RegisterAuthorizationServer(server, authorization)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus(pdpv1.DecisionService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(rpc.AuthorizationServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(server, healthServer)
+
+	reflection.Register(server)
+
+	go func() {
+		err := server.Serve(listener)
+		if err != nil {
+			slog.Error("grpc server exited", slog.String("error", err.Error()))
+		}
+	}()
+
+	return server, nil
+}
+
+// logDestinations builds the decision log destinations from the single
+// destination settings, and the list in PDP_LOG_HTTP_DESTINATIONS.
+func logDestinations() ([]pdp.DecisionLogDestination, error) {
+	var destinations []pdp.DecisionLogDestination
+	if config.PolicyLogServer != "" {
+		destinations = append(destinations, pdp.DecisionLogDestination{
+			Name:                "default",
+			Endpoint:            util.FormatURL(config.PolicyLogServer, config.PolicyLogServerEndpoint, config.PolicyLogServerTLS),
+			EndpointTimeout:     5,
+			BearerToken:         config.PolicyLogServerToken,
+			MaxBacklogBytes:     int64(config.PolicyLogMaxBacklogBytes),
+			UploadTriggerBytes:  int64(config.PolicyLogUploadTriggerBytes),
+			UploadTriggerEvents: int64(config.PolicyLogUploadTriggerEvents),
+			UploadConcurrency:   &config.PolicyLogUploadConcurrency,
+			MaxUploadAttempts:   config.PolicyLogMaxUploadAttempts,
+			DeadLetterDir:       config.PolicyLogDeadLetterDir,
+		})
+	}
+
+	extra, err := config.LogDestinations()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range extra {
+		d := extra[i]
+		destinations = append(destinations, pdp.DecisionLogDestination{
+			Name:                d.Name,
+			Format:              d.Format,
+			Filter:              func(r pdp.DecisionResult) bool { return d.PathFilter(r.Path) },
+			Endpoint:            util.FormatURL(d.Server, d.Endpoint, *d.TLS),
+			EndpointTimeout:     d.Timeout,
+			BearerToken:         d.Token,
+			MaxBacklogBytes:     d.MaxBacklogBytes,
+			UploadTriggerBytes:  d.UploadTriggerBytes,
+			UploadTriggerEvents: d.UploadTriggerEvents,
+			UploadConcurrency:   d.UploadConcurrency,
+			MaxUploadAttempts:   d.MaxUploadAttempts,
+			DeadLetterDir:       d.DeadLetterDir,
+		})
+	}
+
+	return destinations, nil
+}
+
+// logPolicyUpdate writes an audit log entry for every policy update, with the
+// modules it changed and the commits it came from.
+func logPolicyUpdate(environment string, event pdp.PolicyUpdateEvent) {
+	names := func(changes []pdp.PolicyModuleChange) []string {
+		list := make([]string, 0, len(changes))
+		for _, c := range changes {
+			list = append(list, c.Name)
+		}
+		return list
+	}
+
+	attrs := []any{
+		slog.String("environment", environment),
+		slog.String("old_revision", event.OldRevision),
+		slog.String("new_revision", event.NewRevision),
+		slog.Any("added", names(event.Added)),
+		slog.Any("modified", names(event.Modified)),
+		slog.Any("removed", names(event.Removed)),
+	}
+
+	for _, s := range event.Sources {
+		group := []any{slog.String("ref", s.NewRevision.Ref), slog.String("hash", s.NewRevision.Hash)}
+		if s.NewRevision.Commit != nil {
+			group = append(group, slog.String("author", s.NewRevision.Commit.Author), slog.String("message", s.NewRevision.Commit.Message))
+		}
+		attrs = append(attrs, slog.Group(s.Source, group...))
+	}
+
+	if event.Error != "" {
+		slog.Error("policy update failed", append(attrs, slog.String("error", event.Error))...)
+		return
+	}
+
+	slog.Info("policy update applied", attrs...)
+}
+
+// policyComposer creates the composer for the policies of an environment, or
+// the default one if env is nil, and loads the initial policies. The cached
+// policies are activated first, so we can serve decisions even if the git
+// server is unavailable.
+func policyComposer(ctx context.Context, permit *pdp.PermitClient, env *config.Environment) (*pdp.PolicyComposer, error) {
+	sources, err := policySources(env)
+	if err != nil {
+		return nil, err
+	}
+
+	name := pdp.DefaultEnvironment
+	if env != nil {
+		name = env.Name
+	}
+
+	composer, err := pdp.NewSourceComposer(sources, func(ctx context.Context, revision string, b []pdp.PolicyBundle) error {
+		return permit.ActivateEnvironment(ctx, name, revision, b)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	composer.Subscribe(func(ctx context.Context, event pdp.PolicyUpdateEvent) {
+		logPolicyUpdate(name, event)
+	})
+
+	cached, err := composer.LoadCached(ctx)
+	if err != nil {
+		slog.Warn("failed to load cached policies", slog.String("environment", name), slog.String("error", err.Error()))
+	}
+
+	// sync the initial policies, the periodic sync is started afterwards
+	err = composer.RunUpdate(ctx)
+	if err != nil && cached {
+		slog.Warn("failed sync permissions, serving cached policies", slog.String("environment", name), slog.String("error", err.Error()))
+	} else if err != nil {
+		return nil, err
+	}
+
+	return composer, nil
+}
+
+// policySources builds the policy sources from the single repository
+// settings, the list in PDP_REPOSITORIES, the local directory and the bundle
+// url. For an environment, repositories following a branch follow the branch
+// of the environment instead, and are cached next to the
+// default cache, suffixed with the environment name.
+func policySources(env *config.Environment) ([]pdp.MountedSource, error) {
+	var projects []pdp.PolicyProject
+	pollInterval := time.Duration(config.PolicyRepositoryPollInterval) * time.Second
+	pollJitter := float64(config.PolicyRepositoryPollJitter) / 100
+
+	if config.PolicyRepository != "" {
+		trust, err := policyTrust(config.PolicyRepositoryTrustedOpenPGPKeys, config.PolicyRepositoryTrustedSSHKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		projects = append(projects, pdp.PolicyProject{
+			Name:         config.PolicyRepositoryName,
+			Url:          config.PolicyRepository,
+			Mount:        config.PolicyRepositoryMount,
+			Branch:       config.PolicyRepositoryBranch,
+			Tag:          config.PolicyRepositoryTag,
+			Version:      config.PolicyRepositoryVersion,
+			Commit:       config.PolicyRepositoryCommit,
+			Root:         config.PolicyRepositoryRoot,
+			Include:      util.SplitList(config.PolicyRepositoryInclude),
+			Exclude:      util.SplitList(config.PolicyRepositoryExclude),
+			CacheDir:     config.PolicyRepositoryCacheDir,
+			PollInterval: pollInterval,
+			PollJitter:   pollJitter,
+			Trust:        *trust,
+			Auth: pdp.PolicyAuth{
+				Method:           config.PolicyRepositoryAuth,
+				SSHKey:           []byte(config.PolicyRepositoryKey),
+				SSHKeyFile:       config.PolicyRepositoryKeyFile,
+				SSHKeyPassphrase: config.PolicyRepositoryKeyPassphrase,
+				KnownHostsFile:   config.PolicyRepositoryKnownHostsFile,
+				KnownHosts:       config.RepositoryKnownHosts(),
+				Username:         config.PolicyRepositoryUsername,
+				Password:         config.PolicyRepositoryPassword,
+				Token:            config.PolicyRepositoryToken,
+			},
+		})
+	}
+
+	extra, err := config.Repositories()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range extra {
+		trust, err := policyTrust(r.TrustedOpenPGPKeys, r.TrustedSSHKeys)
+		if err != nil {
+			return nil, err
+		}
+
+		projects = append(projects, pdp.PolicyProject{
+			Name:         r.Name,
+			Url:          r.Url,
+			Mount:        r.Mount,
+			Branch:       r.Branch,
+			Tag:          r.Tag,
+			Version:      r.Version,
+			Commit:       r.Commit,
+			Root:         r.Root,
+			Include:      r.Include,
+			Exclude:      r.Exclude,
+			CacheDir:     r.CacheDir,
+			PollInterval: pollInterval,
+			PollJitter:   pollJitter,
+			Trust:        *trust,
+			Auth: pdp.PolicyAuth{
+				Method:           r.Auth,
+				SSHKey:           []byte(r.Key),
+				SSHKeyFile:       r.KeyFile,
+				SSHKeyPassphrase: r.KeyPassphrase,
+				KnownHostsFile:   r.KnownHostsFile,
+				KnownHosts:       r.PinnedHosts(),
+				Username:         r.Username,
+				Password:         r.Password,
+				Token:            r.Token,
+			},
+		})
+	}
+
+	var sources []pdp.MountedSource
+	for _, project := range projects {
+		if env != nil {
+			if project.Tag == "" && project.Version == "" && project.Commit == "" {
+				project.Branch = env.Branch
+			}
+			if project.CacheDir != "" {
+				project.CacheDir = strings.TrimRight(project.CacheDir, "/") + "-" + env.Name
+			}
+		}
+
+		sources = append(sources, pdp.MountedSource{
+			Source:       pdp.NewGitSource(project),
+			Mount:        project.Mount,
+			PollInterval: project.PollInterval,
+			PollJitter:   project.PollJitter,
+		})
+	}
+
+	if config.PolicyDirectory != "" {
+		sources = append(sources, pdp.MountedSource{
+			Source: pdp.NewDirectorySource(pdp.PolicyDirectory{
+				Name:     "local",
+				Path:     config.PolicyDirectory,
+				Debounce: time.Duration(config.PolicyDirectoryDebounce) * time.Millisecond,
+			}),
+			Mount:        config.PolicyDirectoryMount,
+			PollInterval: pollInterval,
+			PollJitter:   pollJitter,
+		})
+	}
+
+	if config.PolicyBundleUrl != "" {
+		verification, err := bundleVerification()
+		if err != nil {
+			return nil, err
+		}
+
+		sources = append(sources, pdp.MountedSource{
+			Source: pdp.NewBundleSource(pdp.PolicyBundleEndpoint{
+				Name:            "bundle",
+				Url:             config.PolicyBundleUrl,
+				BearerToken:     config.PolicyBundleToken,
+				LongPollTimeout: time.Duration(config.PolicyBundleLongPollTimeout) * time.Second,
+				Verification:    verification,
+			}),
+			Mount:        config.PolicyBundleMount,
+			PollInterval: pollInterval,
+			PollJitter:   pollJitter,
+		})
+	}
+
+	return sources, nil
+}
+
+// policyTrust reads the keys policy revisions must be signed by. The OpenPGP
+// file holds armored public keys, the ssh file holds public keys in
+// authorized_keys format, one per line.
+func policyTrust(openPGPKeysFile string, sshKeysFile string) (*pdp.PolicyTrust, error) {
+	trust := &pdp.PolicyTrust{}
+	if openPGPKeysFile != "" {
+		keys, err := os.ReadFile(openPGPKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		trust.OpenPGPKeys = []string{string(keys)}
+	}
+
+	if sshKeysFile != "" {
+		keys, err := os.ReadFile(sshKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, line := range strings.Split(string(keys), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				trust.SSHKeys = append(trust.SSHKeys, line)
+			}
+		}
+	}
+
+	return trust, nil
+}
+
+// bundleVerification reads the keys bundles must be signed with, from a file
+// holding either a PEM encoded public key or a JWKS. It returns nil if no
+// keys are configured.
+func bundleVerification() (*pdp.BundleVerification, error) {
+	if config.PolicyBundleVerificationKeys == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(config.PolicyBundleVerificationKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	verification := &pdp.BundleVerification{
+		KeyID:   config.PolicyBundleVerificationKeyID,
+		Scope:   config.PolicyBundleVerificationScope,
+		Exclude: util.SplitList(config.PolicyBundleVerificationExclude),
+	}
+
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		verification.Keys, err = pdp.ParseJWKS(data)
+		return verification, err
+	}
+
+	// a single key is used for every signature, whatever key id it names
+	if verification.KeyID == "" {
+		verification.KeyID = "default"
+	}
+
+	verification.Keys = []pdp.BundleKey{{
+		ID:        verification.KeyID,
+		Algorithm: config.PolicyBundleVerificationAlgorithm,
+		Key:       string(data),
+	}}
+	return verification, nil
+}
@@ -14,8 +14,47 @@ var Enviroment = GetEnv("PDP_ENV", "PROD")
 var LogLevel = slog.Level(GetEnv("PDP_LOG_LEVEL", 0))
 
 var PolicyRepository = GetEnv("PDP_REPOSITORY", "")
+var PolicyRepositoryName = GetEnv("PDP_REPOSITORY_NAME", "default")
+var PolicyRepositoryMount = GetEnv("PDP_REPOSITORY_MOUNT", "")
 var PolicyRepositoryBranch = GetEnv("PDP_REPOSITORY_BRANCH", "main")
+var PolicyRepositoryTag = GetEnv("PDP_REPOSITORY_TAG", "")
+var PolicyRepositoryVersion = GetEnv("PDP_REPOSITORY_VERSION", "")
+var PolicyRepositoryCommit = GetEnv("PDP_REPOSITORY_COMMIT", "")
 var PolicyRepositoryKey = GetEnv("PDP_REPOSITORY_KEY", "")
+var PolicyRepositoryKeyFile = GetEnv("PDP_REPOSITORY_KEY_FILE", "")
+var PolicyRepositoryKeyPassphrase = GetEnv("PDP_REPOSITORY_KEY_PASSPHRASE", "")
+var PolicyRepositoryKnownHostsFile = GetEnv("PDP_REPOSITORY_KNOWN_HOSTS_FILE", "")
+var PolicyRepositoryKnownHosts = GetEnv("PDP_REPOSITORY_KNOWN_HOSTS", "")
+var PolicyRepositoryTrustedOpenPGPKeys = GetEnv("PDP_REPOSITORY_TRUSTED_OPENPGP_KEYS", "")
+var PolicyRepositoryTrustedSSHKeys = GetEnv("PDP_REPOSITORY_TRUSTED_SSH_KEYS", "")
+var PolicyRepositoryRoot = GetEnv("PDP_REPOSITORY_ROOT", "")
+var PolicyRepositoryInclude = GetEnv("PDP_REPOSITORY_INCLUDE", "")
+var PolicyRepositoryExclude = GetEnv("PDP_REPOSITORY_EXCLUDE", "")
+var PolicyRepositoryCacheDir = GetEnv("PDP_REPOSITORY_CACHE_DIR", "")
+var PolicyRepositoryPollInterval = GetEnv("PDP_REPOSITORY_POLL_INTERVAL", 60)
+var PolicyRepositoryPollJitter = GetEnv("PDP_REPOSITORY_POLL_JITTER", 10)
+var PolicyWebhookSecret = GetEnv("PDP_WEBHOOK_SECRET", "")
+var PolicyHistoryCacheSize = GetEnv("PDP_HISTORY_CACHE_SIZE", 8)
+var HealthMaxStaleness = GetEnv("PDP_HEALTH_MAX_STALENESS", 0)
+var GrpcAddress = GetEnv("PDP_GRPC_ADDRESS", "")
+var EnvoyAuthorizationPath = GetEnv("PDP_ENVOY_AUTHZ_PATH", "envoy/authz/allow")
+var AdmissionPath = GetEnv("PDP_ADMISSION_PATH", "kubernetes/admission/response")
+var PolicyDirectory = GetEnv("PDP_POLICY_DIRECTORY", "")
+var PolicyDirectoryMount = GetEnv("PDP_POLICY_DIRECTORY_MOUNT", "")
+var PolicyDirectoryDebounce = GetEnv("PDP_POLICY_DIRECTORY_DEBOUNCE", 500)
+var PolicyBundleUrl = GetEnv("PDP_BUNDLE_URL", "")
+var PolicyBundleToken = GetEnv("PDP_BUNDLE_TOKEN", "")
+var PolicyBundleMount = GetEnv("PDP_BUNDLE_MOUNT", "")
+var PolicyBundleLongPollTimeout = GetEnv("PDP_BUNDLE_LONG_POLL_TIMEOUT", 0)
+var PolicyBundleVerificationKeys = GetEnv("PDP_BUNDLE_VERIFICATION_KEYS", "")
+var PolicyBundleVerificationKeyID = GetEnv("PDP_BUNDLE_VERIFICATION_KEY_ID", "")
+var PolicyBundleVerificationAlgorithm = GetEnv("PDP_BUNDLE_VERIFICATION_ALGORITHM", "RS256")
+var PolicyBundleVerificationScope = GetEnv("PDP_BUNDLE_VERIFICATION_SCOPE", "")
+var PolicyBundleVerificationExclude = GetEnv("PDP_BUNDLE_VERIFICATION_EXCLUDE", "")
+var PolicyRepositoryAuth = GetEnv("PDP_REPOSITORY_AUTH", "")
+var PolicyRepositoryUsername = GetEnv("PDP_REPOSITORY_USERNAME", "")
+var PolicyRepositoryPassword = GetEnv("PDP_REPOSITORY_PASSWORD", "")
+var PolicyRepositoryToken = GetEnv("PDP_REPOSITORY_TOKEN", "")
 
 var PolicyServerLogConsole = GetEnv("PDP_LOG_CONSOLE", true)
 var PolicyServerLogHTTP = GetEnv("PDP_LOG_HTTP", false)
@@ -24,6 +63,12 @@ var PolicyLogServer = GetEnv("PDP_LOG_HTTP_SERVER", "")
 var PolicyLogServerEndpoint = GetEnv("PDP_LOG_HTTP_SERVER_ENDPOINT", "/api/v1/decision/logs")
 var PolicyLogServerToken = GetEnv("PDP_LOG_HTTP_SERVER_TOKEN", "")
 var PolicyLogServerTLS = GetEnv("PDP_LOG_HTTP_SERVER_TLS", true)
+var PolicyLogMaxBacklogBytes = GetEnv("PDP_LOG_HTTP_MAX_BACKLOG_BYTES", 0)
+var PolicyLogUploadTriggerBytes = GetEnv("PDP_LOG_HTTP_UPLOAD_TRIGGER_BYTES", 0)
+var PolicyLogUploadTriggerEvents = GetEnv("PDP_LOG_HTTP_UPLOAD_TRIGGER_EVENTS", 0)
+var PolicyLogUploadConcurrency = GetEnv("PDP_LOG_HTTP_UPLOAD_CONCURRENCY", 4)
+var PolicyLogMaxUploadAttempts = GetEnv("PDP_LOG_HTTP_MAX_UPLOAD_ATTEMPTS", 0)
+var PolicyLogDeadLetterDir = GetEnv("PDP_LOG_HTTP_DEAD_LETTER_DIR", "")
 
 type EnvType interface {
 	string | int | bool
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// LogDestination is an additional decision log destination, configured as a
+// json list in PDP_LOG_HTTP_DESTINATIONS.
+type LogDestination struct {
+	Name                string   `json:"name"`
+	Server              string   `json:"server"`
+	Endpoint            string   `json:"endpoint"`
+	Token               string   `json:"token"`
+	TLS                 *bool    `json:"tls"`
+	Timeout             int      `json:"timeout"`
+	Format              string   `json:"format"`
+	Paths               []string `json:"paths"` // only upload decisions for these path prefixes, empty uploads all
+	MaxBacklogBytes     int64    `json:"maxBacklogBytes"`
+	UploadTriggerBytes  int64    `json:"uploadTriggerBytes"`
+	UploadTriggerEvents int64    `json:"uploadTriggerEvents"`
+	UploadConcurrency   *int     `json:"uploadConcurrency"`
+	MaxUploadAttempts   int      `json:"maxUploadAttempts"`
+	DeadLetterDir       string   `json:"deadLetterDir"`
+}
+
+var PolicyLogDestinations = GetEnv("PDP_LOG_HTTP_DESTINATIONS", "")
+
+// LogDestinations parses PDP_LOG_HTTP_DESTINATIONS, and injects the defaults
+// of the single destination settings.
+func LogDestinations() ([]LogDestination, error) {
+	if strings.TrimSpace(PolicyLogDestinations) == "" {
+		return nil, nil
+	}
+
+	var destinations []LogDestination
+	if err := json.Unmarshal([]byte(PolicyLogDestinations), &destinations); err != nil {
+		return nil, err
+	}
+
+	for i := range destinations {
+		d := &destinations[i]
+		if d.Endpoint == "" {
+			d.Endpoint = PolicyLogServerEndpoint
+		}
+		if d.TLS == nil {
+			tls := true
+			d.TLS = &tls
+		}
+		if d.Timeout == 0 {
+			d.Timeout = 5
+		}
+	}
+
+	return destinations, nil
+}
+
+// PathFilter returns true for decisions whose path starts with one of the
+// configured prefixes.
+func (d *LogDestination) PathFilter(path string) bool {
+	if len(d.Paths) == 0 {
+		return true
+	}
+
+	path = strings.TrimPrefix(path, "/")
+	for _, prefix := range d.Paths {
+		if strings.HasPrefix(path, strings.TrimPrefix(prefix, "/")) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,47 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Environment is a set of policies loaded from its own branch of the policy
+// repositories, configured in PDP_ENVIRONMENTS as a comma separated list of
+// name=branch, or just the name if it equals the branch.
+type Environment struct {
+	Name   string
+	Branch string
+}
+
+var PolicyEnvironments = GetEnv("PDP_ENVIRONMENTS", "")
+
+// Environments parses PDP_ENVIRONMENTS.
+func Environments() ([]Environment, error) {
+	var environments []Environment
+	seen := make(map[string]struct{})
+	for _, item := range strings.Split(PolicyEnvironments, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		name, branch, found := strings.Cut(item, "=")
+		name, branch = strings.TrimSpace(name), strings.TrimSpace(branch)
+		if !found {
+			branch = name
+		}
+
+		if name == "" || branch == "" {
+			return nil, fmt.Errorf("invalid environment: %s", item)
+		}
+
+		if _, ok := seen[name]; ok {
+			return nil, fmt.Errorf("duplicate environment: %s", name)
+		}
+		seen[name] = struct{}{}
+
+		environments = append(environments, Environment{Name: name, Branch: branch})
+	}
+
+	return environments, nil
+}
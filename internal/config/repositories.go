@@ -0,0 +1,85 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// Repository is an additional policy repository, configured as a json list
+// in PDP_REPOSITORIES.
+type Repository struct {
+	Name               string   `json:"name"`
+	Url                string   `json:"url"`
+	Mount              string   `json:"mount"` // package prefix the repository owns, e.g. platform.lib
+	Branch             string   `json:"branch"`
+	Tag                string   `json:"tag"`
+	Version            string   `json:"version"`
+	Commit             string   `json:"commit"`
+	Root               string   `json:"root"`
+	Include            []string `json:"include"`
+	Exclude            []string `json:"exclude"`
+	CacheDir           string   `json:"cacheDir"`
+	Auth               string   `json:"auth"`
+	Key                string   `json:"key"` // private key for ssh, like PDP_REPOSITORY_KEY
+	KeyFile            string   `json:"keyFile"`
+	KeyPassphrase      string   `json:"keyPassphrase"`
+	KnownHostsFile     string   `json:"knownHostsFile"`
+	KnownHosts         string   `json:"knownHosts"` // pinned ssh host keys, one per line, like PDP_REPOSITORY_KNOWN_HOSTS
+	Username           string   `json:"username"`
+	Password           string   `json:"password"`
+	Token              string   `json:"token"`
+	TrustedOpenPGPKeys string   `json:"trustedOpenPGPKeys"`
+	TrustedSSHKeys     string   `json:"trustedSSHKeys"`
+}
+
+var PolicyRepositories = GetEnv("PDP_REPOSITORIES", "")
+
+// Repositories parses PDP_REPOSITORIES, and injects the defaults of the
+// single repository settings.
+func Repositories() ([]Repository, error) {
+	if strings.TrimSpace(PolicyRepositories) == "" {
+		return nil, nil
+	}
+
+	var repositories []Repository
+	if err := json.Unmarshal([]byte(PolicyRepositories), &repositories); err != nil {
+		return nil, err
+	}
+
+	for i := range repositories {
+		r := &repositories[i]
+		if r.Name == "" {
+			r.Name = r.Url
+		}
+		if r.Branch == "" {
+			r.Branch = PolicyRepositoryBranch
+		}
+		if r.KnownHostsFile == "" {
+			r.KnownHostsFile = PolicyRepositoryKnownHostsFile
+		}
+	}
+
+	return repositories, nil
+}
+
+// RepositoryKnownHosts returns the pinned host keys of PDP_REPOSITORY_KNOWN_HOSTS.
+func RepositoryKnownHosts() []string {
+	return splitKnownHosts(PolicyRepositoryKnownHosts)
+}
+
+// PinnedHosts returns the pinned host keys of the repository.
+func (r *Repository) PinnedHosts() []string {
+	return splitKnownHosts(r.KnownHosts)
+}
+
+// splitKnownHosts splits host keys given one per line, without blank lines.
+func splitKnownHosts(s string) []string {
+	var hosts []string
+	for _, line := range strings.Split(s, "\n") {
+		if strings.TrimSpace(line) != "" {
+			hosts = append(hosts, line)
+		}
+	}
+
+	return hosts
+}
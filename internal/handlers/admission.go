@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickfnielsen/pdp-client/internal/models"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
+// AdmissionReviewVersion is the only AdmissionReview version the webhook
+// accepts.
+const AdmissionReviewVersion = "admission.k8s.io/v1"
+
+// AdmissionRoutes implements a Kubernetes validating and mutating admission
+// webhook, evaluating the decision at Path with the AdmissionReview as input.
+// The environment is selected with the environment query parameter, as the
+// api server can't send custom headers.
+type AdmissionRoutes struct {
+	Permit       *pdp.PermitClient
+	Composer     *pdp.PolicyComposer
+	Environments map[string]*pdp.PolicyComposer
+	Path         string
+}
+
+// admissionResult is the decision of the policy, either a bool or an object
+// with these fields. The patch is a list of JSONPatch operations, and only
+// applied when the request is allowed.
+type admissionResult struct {
+	Allowed  bool              `json:"allowed"`
+	Message  string            `json:"message"`
+	Code     int               `json:"code"`
+	Warnings []string          `json:"warnings"`
+	Patch    []json.RawMessage `json:"patch"`
+}
+
+func (r *AdmissionRoutes) Review(c *fiber.Ctx) error {
+	var review models.AdmissionReview
+	if err := json.Unmarshal(c.Body(), &review); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid admission review: "+err.Error())
+	}
+
+	if review.APIVersion != AdmissionReviewVersion || review.Kind != "AdmissionReview" || review.Request == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "expected an "+AdmissionReviewVersion+" AdmissionReview request")
+	}
+
+	env := c.Query("environment")
+	composer := r.Composer
+	if env != pdp.DefaultEnvironment {
+		composer = r.Environments[env]
+	}
+
+	if !r.Permit.HasEnvironment(env) || composer == nil {
+		return fiber.NewError(fiber.StatusBadRequest, "unknown environment: "+env)
+	}
+
+	// the api server applies the failure policy of the webhook
+	if !r.Permit.EnvironmentReady(env) {
+		return fiber.NewError(fiber.StatusServiceUnavailable, "PDP not ready: no policies loaded")
+	}
+
+	// the review is passed as is, so policies see every field of the request
+	var input interface{}
+	if err := json.Unmarshal(c.Body(), &input); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid admission review: "+err.Error())
+	}
+
+	decision, err := r.Permit.Decision(c.UserContext(), pdp.DecisionOptions{
+		RemoteAddr:  c.IP(),
+		Path:        r.Path,
+		Input:       input,
+		Environment: env,
+	})
+
+	// an undefined decision denies the request, so a missing policy can't
+	// admit everything
+	result := &admissionResult{Message: "no admission policy defined"}
+	if errors.Is(err, pdp.ErrUndefinedDecision) {
+		slog.Warn("admission decision was undefined, denying", slog.String("path", r.Path))
+	} else if err != nil {
+		slog.Error("admission decision error", slog.String("error", err.Error()))
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	} else if result, err = parseAdmissionResult(decision.Result); err != nil {
+		slog.Error("invalid admission decision", slog.String("path", r.Path), slog.String("error", err.Error()))
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	response, err := admissionResponse(review.Request.UID, result)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	// stamp the decision and policy revision on the audit event of the request,
+	// an undefined decision has no result to take the revision from
+	response.AuditAnnotations = map[string]string{"revision": composer.Revision()}
+	if decision != nil {
+		response.AuditAnnotations["revision"] = decision.Revision
+		response.AuditAnnotations["decision-id"] = decision.ID
+	}
+
+	return c.JSON(models.AdmissionReview{
+		APIVersion: AdmissionReviewVersion,
+		Kind:       "AdmissionReview",
+		Response:   response,
+	})
+}
+
+// parseAdmissionResult reads a bool or object decision.
+func parseAdmissionResult(v interface{}) (*admissionResult, error) {
+	if allowed, ok := v.(bool); ok {
+		return &admissionResult{Allowed: allowed}, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var result admissionResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, errors.Join(err, errors.New("decision must be a bool or an object"))
+	}
+
+	return &result, nil
+}
+
+func admissionResponse(uid string, result *admissionResult) (*models.AdmissionResponse, error) {
+	response := &models.AdmissionResponse{
+		UID:      uid,
+		Allowed:  result.Allowed,
+		Warnings: result.Warnings,
+	}
+
+	if !result.Allowed {
+		code := result.Code
+		if code == 0 {
+			code = fiber.StatusForbidden
+		}
+
+		response.Status = &models.AdmissionStatus{Code: code, Message: result.Message}
+		return response, nil
+	}
+
+	if result.Message != "" {
+		response.Status = &models.AdmissionStatus{Message: result.Message}
+	}
+
+	if len(result.Patch) > 0 {
+		patch, err := json.Marshal(result.Patch)
+		if err != nil {
+			return nil, err
+		}
+
+		// encoded as base64 by encoding/json, as the api server expects
+		response.Patch = patch
+		response.PatchType = "JSONPatch"
+	}
+
+	return response, nil
+}
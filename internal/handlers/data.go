@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/open-policy-agent/opa/server/types"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
+// DataRoutes implements the decision part of the OPA Data API, so services
+// using an OPA client can use the PDP without changes.
+type DataRoutes struct {
+	Permit       *pdp.PermitClient
+	Composer     *pdp.PolicyComposer
+	Environments map[string]*pdp.PolicyComposer
+	Version      string
+}
+
+// Get evaluates the decision at the path, with the input as json in the input
+// query parameter.
+func (r *DataRoutes) Get(c *fiber.Ctx) error {
+	var input *interface{}
+	if raw := c.Query("input"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &input); err != nil {
+			return r.error(c, fiber.StatusBadRequest, types.NewErrorV1(types.CodeInvalidParameter, "invalid input: %s", err.Error()))
+		}
+	}
+
+	return r.decision(c, input)
+}
+
+// Post evaluates the decision at the path, with the input in the body.
+func (r *DataRoutes) Post(c *fiber.Ctx) error {
+	var req types.DataRequestV1
+	if body := c.Body(); len(body) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			return r.error(c, fiber.StatusBadRequest, types.NewErrorV1(types.CodeInvalidParameter, "invalid request body: %s", err.Error()))
+		}
+	}
+
+	return r.decision(c, req.Input)
+}
+
+func (r *DataRoutes) decision(c *fiber.Ctx, input *interface{}) error {
+	env := c.Get(EnvironmentHeader)
+	composer := r.Composer
+	if env != pdp.DefaultEnvironment {
+		composer = r.Environments[env]
+	}
+
+	if !r.Permit.HasEnvironment(env) || composer == nil {
+		return r.error(c, fiber.StatusBadRequest, types.NewErrorV1(types.CodeInvalidParameter, "unknown environment: %s", env))
+	}
+
+	if !r.Permit.EnvironmentReady(env) {
+		return r.error(c, fiber.StatusServiceUnavailable, types.NewErrorV1(types.CodeInternal, "PDP not ready: no policies loaded"))
+	}
+
+	explain := c.Query(types.ParamExplainV1)
+	switch types.ExplainModeV1(explain) {
+	case "", types.ExplainNotesV1, types.ExplainFailsV1, types.ExplainFullV1, types.ExplainDebugV1:
+	default:
+		return r.error(c, fiber.StatusBadRequest, types.NewErrorV1(types.CodeInvalidParameter, "invalid explain mode: %s", explain))
+	}
+
+	options := pdp.DecisionOptions{
+		RemoteAddr:  c.IP(),
+		Path:        c.Params("*"),
+		Environment: env,
+		Explain:     explain,
+		Metrics:     queryBool(c, "metrics"),
+	}
+	if input != nil {
+		options.Input = *input
+	}
+
+	decision, err := r.Permit.Decision(c.UserContext(), options)
+	if errors.Is(err, pdp.ErrUndefinedDecision) {
+		return r.json(c, fiber.StatusOK, types.DataResponseV1{})
+	} else if err != nil {
+		slog.Error("decision error", slog.String("error", err.Error()))
+		return r.error(c, fiber.StatusInternalServerError, types.NewErrorV1(types.CodeInternal, err.Error()))
+	}
+
+	response := types.DataResponseV1{
+		DecisionID: decision.ID,
+		Result:     &decision.Result,
+		Metrics:    decision.Metrics,
+	}
+
+	if options.Explain != "" {
+		response.Explanation, err = types.NewTraceV1(decision.Explanation, queryBool(c, "pretty"))
+		if err != nil {
+			return r.error(c, fiber.StatusInternalServerError, types.NewErrorV1(types.CodeInternal, err.Error()))
+		}
+	}
+
+	if queryBool(c, "provenance") {
+		response.Provenance = r.provenance(composer)
+	}
+
+	return r.json(c, fiber.StatusOK, response)
+}
+
+// provenance describes the PDP and the revisions of its policy sources.
+func (r *DataRoutes) provenance(composer *pdp.PolicyComposer) *types.ProvenanceV1 {
+	provenance := &types.ProvenanceV1{
+		Version:  r.Version,
+		Revision: composer.Revision(),
+		Bundles:  make(map[string]types.ProvenanceBundleV1),
+	}
+
+	for name, revision := range composer.SourceRevisions() {
+		provenance.Bundles[name] = types.ProvenanceBundleV1{Revision: revision}
+	}
+
+	return provenance
+}
+
+func (r *DataRoutes) error(c *fiber.Ctx, status int, err *types.ErrorV1) error {
+	return r.json(c, status, err)
+}
+
+// json writes the response, indented if the pretty query parameter is set.
+func (r *DataRoutes) json(c *fiber.Ctx, status int, v interface{}) error {
+	if !queryBool(c, "pretty") {
+		return c.Status(status).JSON(v)
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Status(status).Send(data)
+}
+
+// queryBool reads a boolean query parameter, which like in OPA is true when
+// given without a value.
+func queryBool(c *fiber.Ctx, key string) bool {
+	args := c.Context().QueryArgs()
+	if !args.Has(key) {
+		return false
+	}
+
+	value := string(args.Peek(key))
+	if value == "" {
+		return true
+	}
+
+	b, _ := strconv.ParseBool(value)
+	return b
+}
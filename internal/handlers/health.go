@@ -0,0 +1,98 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickfnielsen/pdp-client/internal/models"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
+type HealthRoutes struct {
+	Permit       *pdp.PermitClient
+	Composer     *pdp.PolicyComposer
+	Environments map[string]*pdp.PolicyComposer
+	MaxStaleness time.Duration // how long ago the policies may have last synced, zero disables the check
+}
+
+// Live reports that the server is running.
+func (r *HealthRoutes) Live(c *fiber.Ctx) error {
+	return c.JSON(models.HealthResponse{Status: "ok"})
+}
+
+// Ready reports whether the server can serve decisions: policies are loaded in
+// every environment, every source synced recently, and the decision logs
+// aren't backed up. It responds with 503 if any check fails.
+func (r *HealthRoutes) Ready(c *fiber.Ctx) error {
+	checks := map[string]models.HealthCheck{
+		"policies":      r.checkPolicies(),
+		"sync":          r.checkSync(),
+		"decision_logs": r.checkDecisionLogs(),
+	}
+
+	response := models.ReadinessResponse{Ready: true, Checks: checks}
+	for _, check := range checks {
+		response.Ready = response.Ready && check.Ready
+	}
+
+	if !response.Ready {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(response)
+	}
+
+	return c.JSON(response)
+}
+
+func (r *HealthRoutes) checkPolicies() models.HealthCheck {
+	if !r.Permit.Ready() {
+		return models.HealthCheck{Message: "no policies loaded"}
+	}
+
+	for env := range r.Environments {
+		if !r.Permit.EnvironmentReady(env) {
+			return models.HealthCheck{Message: "no policies loaded in environment " + env}
+		}
+	}
+
+	return models.HealthCheck{Ready: true}
+}
+
+func (r *HealthRoutes) checkSync() models.HealthCheck {
+	if r.MaxStaleness <= 0 {
+		return models.HealthCheck{Ready: true, Message: "disabled"}
+	}
+
+	composers := map[string]*pdp.PolicyComposer{pdp.DefaultEnvironment: r.Composer}
+	for env, composer := range r.Environments {
+		composers[env] = composer
+	}
+
+	for env, composer := range composers {
+		for _, source := range composer.Status().Sources {
+			if age := time.Since(source.LastSuccess); age > r.MaxStaleness {
+				name := source.Source
+				if env != pdp.DefaultEnvironment {
+					name = env + "/" + name
+				}
+
+				if source.LastSuccess.IsZero() {
+					return models.HealthCheck{Message: fmt.Sprintf("policy source %s never synced", name)}
+				}
+
+				return models.HealthCheck{Message: fmt.Sprintf("policy source %s last synced %s ago", name, age.Round(time.Second))}
+			}
+		}
+	}
+
+	return models.HealthCheck{Ready: true}
+}
+
+func (r *HealthRoutes) checkDecisionLogs() models.HealthCheck {
+	for _, d := range r.Permit.LoggerStatus().Destinations {
+		if d.BacklogExceeded {
+			return models.HealthCheck{Message: fmt.Sprintf("decision log destination %s exceeds its backlog limit", d.Destination)}
+		}
+	}
+
+	return models.HealthCheck{Ready: true}
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickfnielsen/pdp-client/internal/models"
+	"github.com/patrickfnielsen/pdp-client/internal/util"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
+type HistoryRoutes struct {
+	TimeTravel   *pdp.TimeTravel
+	Environments map[string]*pdp.TimeTravel
+}
+
+// Decision evaluates a decision against the policies of a past commit or
+// time, without touching the active policies.
+func (r *HistoryRoutes) Decision(c *fiber.Ctx) error {
+	req, valErrs := util.ReadAndValidate[models.HistoricalDecisionRequest](c)
+	if valErrs != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(valErrs)
+	}
+
+	if (req.Commit == "") == req.Time.IsZero() {
+		return fiber.NewError(fiber.StatusBadRequest, "either commit or time is required")
+	}
+
+	timeTravel := r.TimeTravel
+	if env := c.Get(EnvironmentHeader); env != pdp.DefaultEnvironment {
+		var ok bool
+		if timeTravel, ok = r.Environments[env]; !ok {
+			return fiber.NewError(fiber.StatusBadRequest, "unknown environment: "+env)
+		}
+	}
+
+	decision, err := timeTravel.Decision(c.UserContext(), pdp.HistoricalRevision{
+		Source: req.Source,
+		Commit: req.Commit,
+		Time:   req.Time,
+	}, pdp.DecisionOptions{
+		RemoteAddr:  c.IP(),
+		Path:        req.Decision.Path,
+		Input:       req.Decision,
+		Environment: c.Get(EnvironmentHeader),
+	})
+	if err != nil {
+		slog.Error("historical decision error", slog.String("error", err.Error()))
+		return fiber.NewError(fiber.StatusUnprocessableEntity, err.Error())
+	}
+
+	return c.JSON(decision)
+}
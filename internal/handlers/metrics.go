@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+var (
+	signatureVerificationsDesc = prometheus.NewDesc(
+		"pdp_policy_signature_verifications_total",
+		"Number of policy revisions whose signature was verified.",
+		[]string{"environment", "source"}, nil,
+	)
+	signatureRefusalsDesc = prometheus.NewDesc(
+		"pdp_policy_signature_refusals_total",
+		"Number of policy revisions refused as they weren't signed by a trusted key.",
+		[]string{"environment", "source"}, nil,
+	)
+)
+
+// MetricsRoutes serves Prometheus metrics, the signature verifications and
+// refusals of every policy source next to the Go runtime metrics.
+type MetricsRoutes struct {
+	Composer     *pdp.PolicyComposer
+	Environments map[string]*pdp.PolicyComposer
+}
+
+// Handler creates the metrics endpoint.
+func (r *MetricsRoutes) Handler() fiber.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		r,
+	)
+
+	handler := fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	return func(c *fiber.Ctx) error {
+		handler(c.Context())
+		return nil
+	}
+}
+
+func (r *MetricsRoutes) Describe(ch chan<- *prometheus.Desc) {
+	ch <- signatureVerificationsDesc
+	ch <- signatureRefusalsDesc
+}
+
+// Collect reads the counters from the signature status of the sources, which
+// count since start like a Prometheus counter.
+func (r *MetricsRoutes) Collect(ch chan<- prometheus.Metric) {
+	r.collectSignatures(ch, pdp.DefaultEnvironment, r.Composer)
+	for env, composer := range r.Environments {
+		r.collectSignatures(ch, env, composer)
+	}
+}
+
+func (r *MetricsRoutes) collectSignatures(ch chan<- prometheus.Metric, env string, composer *pdp.PolicyComposer) {
+	for source, status := range composer.SignatureStatus() {
+		ch <- prometheus.MustNewConstMetric(signatureVerificationsDesc, prometheus.CounterValue, float64(status.Verifications), env, source)
+		ch <- prometheus.MustNewConstMetric(signatureRefusalsDesc, prometheus.CounterValue, float64(status.Refusals), env, source)
+	}
+}
@@ -9,6 +9,10 @@ import (
 	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
 )
 
+// EnvironmentHeader selects the environment whose policies are used, the
+// default environment is used without it.
+const EnvironmentHeader = "X-PDP-Environment"
+
 type PdpRoutes struct {
 	Permit *pdp.PermitClient
 }
@@ -19,16 +23,22 @@ func (r *PdpRoutes) PdpCheck(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(valErrs)
 	}
 
+	env := c.Get(EnvironmentHeader)
+	if !r.Permit.HasEnvironment(env) {
+		return fiber.NewError(fiber.StatusBadRequest, "unknown environment: "+env)
+	}
+
 	// verify that policies have been loaded
-	if !r.Permit.Ready() {
+	if !r.Permit.EnvironmentReady(env) {
 		return fiber.NewError(fiber.StatusServiceUnavailable, "PDP not ready: no policies loaded")
 	}
 
 	// make a permit decision
 	decision, err := r.Permit.Decision(c.UserContext(), pdp.DecisionOptions{
-		RemoteAddr: c.IP(),
-		Path:       req.Path,
-		Input:      req,
+		RemoteAddr:  c.IP(),
+		Path:        req.Path,
+		Input:       req,
+		Environment: env,
 	})
 	if err != nil {
 		slog.Error("decision error", slog.String("error", err.Error()))
@@ -37,3 +47,33 @@ func (r *PdpRoutes) PdpCheck(c *fiber.Ctx) error {
 
 	return c.JSON(models.DecisionResponse{DecisionID: decision.ID, Result: decision.Result})
 }
+
+func (r *PdpRoutes) LoggerStatus(c *fiber.Ctx) error {
+	status := r.Permit.LoggerStatus()
+	if status.BacklogExceeded() {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(status)
+	}
+
+	return c.JSON(status)
+}
+
+func (r *PdpRoutes) DeadLetters(c *fiber.Ctx) error {
+	entries, err := r.Permit.DeadLetters()
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, err.Error())
+	}
+
+	return c.JSON(models.DeadLetterResponse{Entries: entries})
+}
+
+func (r *PdpRoutes) ReplayDeadLetters(c *fiber.Ctx) error {
+	replayed, err := r.Permit.ReplayDeadLetters(c.UserContext())
+	response := models.ReplayResponse{Replayed: replayed}
+	if err != nil {
+		slog.Error("dead-letter replay error", slog.String("error", err.Error()))
+		response.Error = err.Error()
+		return c.Status(fiber.StatusBadGateway).JSON(response)
+	}
+
+	return c.JSON(response)
+}
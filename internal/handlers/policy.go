@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickfnielsen/pdp-client/internal/models"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
+type PolicyRoutes struct {
+	Composer     *pdp.PolicyComposer
+	Environments map[string]*pdp.PolicyComposer
+}
+
+func (r *PolicyRoutes) SignatureStatus(c *fiber.Ctx) error {
+	composer, err := r.composer(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(composer.SignatureStatus())
+}
+
+func (r *PolicyRoutes) Revision(c *fiber.Ctx) error {
+	composer, err := r.composer(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(models.PolicyRevisionResponse{
+		Revision: composer.Revision(),
+		Sources:  composer.SourceRevisions(),
+	})
+}
+
+func (r *PolicyRoutes) Status(c *fiber.Ctx) error {
+	composer, err := r.composer(c)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(composer.Status())
+}
+
+// composer returns the composer of the environment in the request header.
+func (r *PolicyRoutes) composer(c *fiber.Ctx) (*pdp.PolicyComposer, error) {
+	env := c.Get(EnvironmentHeader)
+	if env == pdp.DefaultEnvironment {
+		return r.Composer, nil
+	}
+
+	composer, ok := r.Environments[env]
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "unknown environment: "+env)
+	}
+
+	return composer, nil
+}
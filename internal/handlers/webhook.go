@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/patrickfnielsen/pdp-client/internal/models"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
+type WebhookRoutes struct {
+	Composer     *pdp.PolicyComposer
+	Environments map[string]*pdp.PolicyComposer
+	Secret       string
+}
+
+// GitPush handles push events from GitHub, GitLab and Gitea, and triggers a
+// policy update when the pushed branch is one we follow, in any environment.
+func (r *WebhookRoutes) GitPush(c *fiber.Ctx) error {
+	event, ok := r.verify(c)
+	if !ok {
+		return fiber.NewError(fiber.StatusUnauthorized, "invalid webhook signature")
+	}
+
+	if event != "push" && event != "Push Hook" {
+		return c.JSON(models.WebhookResponse{Triggered: false, Reason: "ignored event: " + event})
+	}
+
+	var payload models.GitPushPayload
+	if err := json.Unmarshal(c.Body(), &payload); err != nil {
+		return fiber.NewError(fiber.StatusBadRequest, "invalid push payload")
+	}
+
+	triggered := r.Composer.TriggerRef(payload.Ref)
+	for _, composer := range r.Environments {
+		triggered = composer.TriggerRef(payload.Ref) || triggered
+	}
+
+	if !triggered {
+		return c.JSON(models.WebhookResponse{Triggered: false, Reason: "ignored ref: " + payload.Ref})
+	}
+
+	slog.Info("policy update triggered by webhook", slog.String("ref", payload.Ref))
+	return c.Status(fiber.StatusAccepted).JSON(models.WebhookResponse{Triggered: true})
+}
+
+// verify checks the signature of the request, and returns the event type.
+// GitHub and Gitea sign the body with a HMAC-SHA256, GitLab sends the secret
+// as a token.
+func (r *WebhookRoutes) verify(c *fiber.Ctx) (string, bool) {
+	if signature := c.Get("X-Hub-Signature-256"); signature != "" {
+		return c.Get("X-GitHub-Event"), r.validHMAC(c.Body(), strings.TrimPrefix(signature, "sha256="))
+	}
+
+	if signature := c.Get("X-Gitea-Signature"); signature != "" {
+		return c.Get("X-Gitea-Event"), r.validHMAC(c.Body(), signature)
+	}
+
+	if token := c.Get("X-Gitlab-Token"); token != "" {
+		return c.Get("X-Gitlab-Event"), subtle.ConstantTimeCompare([]byte(token), []byte(r.Secret)) == 1
+	}
+
+	return "", false
+}
+
+func (r *WebhookRoutes) validHMAC(body []byte, signature string) bool {
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(r.Secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -1,5 +1,11 @@
 package models
 
+import (
+	"time"
+
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
 type DecisionUser struct {
 	Key        string `validate:"required"`
 	Attributes map[string]string
@@ -20,3 +26,77 @@ type DecisionResponse struct {
 	DecisionID string      `json:"decision_id"`
 	Result     interface{} `json:"result"`
 }
+
+type DeadLetterResponse struct {
+	Entries []pdp.DeadLetterEntry `json:"entries"`
+}
+
+type ReplayResponse struct {
+	Replayed int    `json:"replayed"`
+	Error    string `json:"error,omitempty"`
+}
+
+type GitPushPayload struct {
+	Ref string `json:"ref"`
+}
+
+type WebhookResponse struct {
+	Triggered bool   `json:"triggered"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+type PolicyRevisionResponse struct {
+	Revision string            `json:"revision"`
+	Sources  map[string]string `json:"sources"`
+}
+
+// HistoricalDecisionRequest evaluates a decision against the policies of a
+// past commit, or as they were at a time.
+type HistoricalDecisionRequest struct {
+	Source   string              `json:"source"`
+	Commit   string              `json:"commit"`
+	Time     time.Time           `json:"time"`
+	Decision pdp.DecisionRequest `validate:"required" json:"decision"`
+}
+
+type HealthResponse struct {
+	Status string `json:"status"`
+}
+
+type ReadinessResponse struct {
+	Ready  bool                   `json:"ready"`
+	Checks map[string]HealthCheck `json:"checks"`
+}
+
+type HealthCheck struct {
+	Ready   bool   `json:"ready"`
+	Message string `json:"message,omitempty"` // why the check failed
+}
+
+// AdmissionReview is the admission.k8s.io/v1 AdmissionReview, with only the
+// fields the PDP reads or writes.
+type AdmissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *AdmissionRequest  `json:"request,omitempty"`
+	Response   *AdmissionResponse `json:"response,omitempty"`
+}
+
+type AdmissionRequest struct {
+	UID string `json:"uid"`
+}
+
+type AdmissionResponse struct {
+	UID              string            `json:"uid"`
+	Allowed          bool              `json:"allowed"`
+	Status           *AdmissionStatus  `json:"status,omitempty"`
+	Patch            []byte            `json:"patch,omitempty"`
+	PatchType        string            `json:"patchType,omitempty"`
+	Warnings         []string          `json:"warnings,omitempty"`
+	AuditAnnotations map[string]string `json:"auditAnnotations,omitempty"`
+}
+
+type AdmissionStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
@@ -0,0 +1,265 @@
+package rpc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"log/slog"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	authv3 "github.com/envoyproxy/go-control-plane/envoy/service/auth/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// AuthorizationServiceName is the full name of the Envoy authorization
+// service, the generated code doesn't export its descriptor.
+const AuthorizationServiceName = "envoy.service.auth.v3.Authorization"
+
+// EnvironmentContextExtension is the context extension, set in the Envoy
+// route or filter config, that selects the environment.
+const EnvironmentContextExtension = "pdp_environment"
+
+// AuthorizationService implements the Envoy external authorization API, so
+// the PDP can authorize requests proxied by Envoy.
+type AuthorizationService struct {
+	authv3.UnimplementedAuthorizationServer
+
+	permit *pdp.PermitClient
+	path   string
+}
+
+// NewAuthorizationService creates the service, evaluating the decision at the
+// path for every request.
+func NewAuthorizationService(permit *pdp.PermitClient, path string) *AuthorizationService {
+	return &AuthorizationService{permit: permit, path: path}
+}
+
+// authorizationResult is the decision of the policy, either a bool or an
+// object with these fields. The headers are added to the upstream request
+// when allowed, and to the response when denied.
+type authorizationResult struct {
+	Allowed                bool                    `json:"allowed"`
+	Headers                map[string]headerValues `json:"headers"`
+	RequestHeadersToRemove []string                `json:"request_headers_to_remove"`
+	ResponseHeadersToAdd   map[string]headerValues `json:"response_headers_to_add"`
+	HTTPStatus             int                     `json:"http_status"`
+	Body                   string                  `json:"body"`
+}
+
+// headerValues is a header value, or a list of them.
+type headerValues []string
+
+func (h *headerValues) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err == nil {
+		*h = headerValues{value}
+		return nil
+	}
+
+	return json.Unmarshal(data, (*[]string)(h))
+}
+
+// Check evaluates the decision for the request. An undefined decision denies
+// the request, and errors are returned so Envoy applies its failure mode.
+func (s *AuthorizationService) Check(ctx context.Context, req *authv3.CheckRequest) (*authv3.CheckResponse, error) {
+	env := req.GetAttributes().GetContextExtensions()[EnvironmentContextExtension]
+	if !s.permit.HasEnvironment(env) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown environment: %s", env)
+	}
+
+	if !s.permit.EnvironmentReady(env) {
+		return nil, status.Error(codes.Unavailable, "PDP not ready: no policies loaded")
+	}
+
+	input, err := authorizationInput(req)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	options := pdp.DecisionOptions{
+		RemoteAddr:  req.GetAttributes().GetSource().GetAddress().GetSocketAddress().GetAddress(),
+		Path:        s.path,
+		Input:       input,
+		Environment: env,
+	}
+
+	decision, err := s.permit.Decision(ctx, options)
+	if errors.Is(err, pdp.ErrUndefinedDecision) {
+		slog.Warn("authorization decision was undefined, denying", slog.String("path", s.path))
+		return checkResponse(&authorizationResult{}), nil
+	} else if err != nil {
+		slog.Error("authorization decision error", slog.String("error", err.Error()))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	result, err := parseAuthorizationResult(decision.Result)
+	if err != nil {
+		slog.Error("invalid authorization decision", slog.String("path", s.path), slog.String("error", err.Error()))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return checkResponse(result), nil
+}
+
+// authorizationInput maps the request into the policy input. The attributes
+// are passed as is, like the OPA Envoy plugin does, next to the method, path,
+// headers, the parsed path and query, and the bearer token.
+func authorizationInput(req *authv3.CheckRequest) (map[string]interface{}, error) {
+	data, err := protojson.Marshal(req.GetAttributes())
+	if err != nil {
+		return nil, err
+	}
+
+	var attributes interface{}
+	if err := json.Unmarshal(data, &attributes); err != nil {
+		return nil, err
+	}
+
+	request := req.GetAttributes().GetRequest().GetHttp()
+	path, rawQuery, _ := strings.Cut(request.GetPath(), "?")
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	parsedPath := []string{}
+	for _, segment := range strings.Split(strings.Trim(path, "/"), "/") {
+		if segment != "" {
+			parsedPath = append(parsedPath, segment)
+		}
+	}
+
+	input := map[string]interface{}{
+		"attributes":   attributes,
+		"method":       request.GetMethod(),
+		"path":         request.GetPath(),
+		"headers":      request.GetHeaders(),
+		"parsed_path":  parsedPath,
+		"parsed_query": query,
+	}
+
+	if jwt := parseBearerToken(request.GetHeaders()["authorization"]); jwt != nil {
+		input["jwt"] = jwt
+	}
+
+	return input, nil
+}
+
+// parseBearerToken decodes the header and payload of a JWT bearer token. The
+// signature isn't verified, that's left to the Envoy jwt_authn filter or the
+// policy.
+func parseBearerToken(authorization string) map[string]interface{} {
+	scheme, token, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "bearer") {
+		return nil
+	}
+
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	jwt := make(map[string]interface{}, 2)
+	for i, name := range []string{"header", "payload"} {
+		data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[i], "="))
+		if err != nil {
+			return nil
+		}
+
+		var claims map[string]interface{}
+		if err := json.Unmarshal(data, &claims); err != nil {
+			return nil
+		}
+		jwt[name] = claims
+	}
+
+	return jwt
+}
+
+// parseAuthorizationResult reads a bool or object decision.
+func parseAuthorizationResult(v interface{}) (*authorizationResult, error) {
+	if allowed, ok := v.(bool); ok {
+		return &authorizationResult{Allowed: allowed}, nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var result authorizationResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, errors.Join(err, errors.New("decision must be a bool or an object"))
+	}
+
+	return &result, nil
+}
+
+func checkResponse(result *authorizationResult) *authv3.CheckResponse {
+	if result.Allowed {
+		return &authv3.CheckResponse{
+			Status: &rpcstatus.Status{Code: int32(codes.OK)},
+			HttpResponse: &authv3.CheckResponse_OkResponse{
+				OkResponse: &authv3.OkHttpResponse{
+					Headers:              headerOptions(result.Headers),
+					HeadersToRemove:      result.RequestHeadersToRemove,
+					ResponseHeadersToAdd: headerOptions(result.ResponseHeadersToAdd),
+				},
+			},
+		}
+	}
+
+	code := result.HTTPStatus
+	if code == 0 {
+		code = http.StatusForbidden
+	}
+
+	return &authv3.CheckResponse{
+		Status: &rpcstatus.Status{Code: int32(codes.PermissionDenied)},
+		HttpResponse: &authv3.CheckResponse_DeniedResponse{
+			DeniedResponse: &authv3.DeniedHttpResponse{
+				Status:  &typev3.HttpStatus{Code: typev3.StatusCode(code)},
+				Headers: headerOptions(result.Headers),
+				Body:    result.Body,
+			},
+		},
+	}
+}
+
+// headerOptions replaces existing headers with the first value, and appends
+// any further values.
+func headerOptions(headers map[string]headerValues) []*corev3.HeaderValueOption {
+	keys := make([]string, 0, len(headers))
+	for key := range headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var options []*corev3.HeaderValueOption
+	for _, key := range keys {
+		for i, value := range headers[key] {
+			action := corev3.HeaderValueOption_APPEND_IF_EXISTS_OR_ADD
+			if i == 0 {
+				action = corev3.HeaderValueOption_OVERWRITE_IF_EXISTS_OR_ADD
+			}
+
+			options = append(options, &corev3.HeaderValueOption{
+				Header:       &corev3.HeaderValue{Key: key, Value: value},
+				AppendAction: action,
+			})
+		}
+	}
+
+	return options
+}
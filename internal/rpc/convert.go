@@ -0,0 +1,97 @@
+package rpc
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+	pdpv1 "github.com/patrickfnielsen/pdp-client/proto/pdp/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// value converts a decision result. Results hold json numbers, which
+// structpb.NewValue doesn't accept, so the result is converted through json.
+func value(v interface{}) (*structpb.Value, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &structpb.Value{}
+	if err := protojson.Unmarshal(data, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func policyStatus(s pdp.PolicyComposerStatus) *pdpv1.PolicyStatusResponse {
+	response := &pdpv1.PolicyStatusResponse{
+		Revision:  s.Revision,
+		LastError: s.LastError,
+	}
+
+	for _, source := range s.Sources {
+		response.Sources = append(response.Sources, &pdpv1.PolicySourceStatus{
+			Source:              source.Source,
+			Ref:                 source.Ref,
+			Hash:                source.Hash,
+			LastAttempt:         timestamp(source.LastAttempt),
+			LastSuccess:         timestamp(source.LastSuccess),
+			LastError:           source.LastError,
+			ConsecutiveFailures: int32(source.ConsecutiveFailures),
+			CurrentBackoff:      durationpb.New(time.Duration(source.CurrentBackoffSeconds * float64(time.Second))),
+			Modules:             source.Modules,
+		})
+	}
+
+	return response
+}
+
+func revisionEvent(e pdp.PolicyUpdateEvent) *pdpv1.RevisionEvent {
+	event := &pdpv1.RevisionEvent{
+		Timestamp:   timestamppb.New(e.Timestamp),
+		OldRevision: e.OldRevision,
+		NewRevision: e.NewRevision,
+		Added:       moduleChanges(e.Added),
+		Modified:    moduleChanges(e.Modified),
+		Removed:     moduleChanges(e.Removed),
+		Error:       e.Error,
+	}
+
+	for _, s := range e.Sources {
+		event.Sources = append(event.Sources, &pdpv1.PolicySourceChange{
+			Source:      s.Source,
+			OldRevision: policyRevision(s.OldRevision),
+			NewRevision: policyRevision(s.NewRevision),
+		})
+	}
+
+	return event
+}
+
+func policyRevision(r pdp.PolicyRevision) *pdpv1.PolicyRevision {
+	revision := &pdpv1.PolicyRevision{Ref: r.Ref, Hash: r.Hash}
+	if r.Commit != nil {
+		revision.Commit = &pdpv1.PolicyCommit{
+			Author:  r.Commit.Author,
+			Email:   r.Commit.Email,
+			Message: r.Commit.Message,
+			Time:    timestamp(r.Commit.Time),
+		}
+	}
+
+	return revision
+}
+
+func moduleChanges(changes []pdp.PolicyModuleChange) []*pdpv1.PolicyModuleChange {
+	result := make([]*pdpv1.PolicyModuleChange, 0, len(changes))
+	for _, c := range changes {
+		result = append(result, &pdpv1.PolicyModuleChange{Name: c.Name, OldHash: c.OldHash, NewHash: c.NewHash})
+	}
+
+	return result
+}
@@ -0,0 +1,217 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+	pdpv1 "github.com/patrickfnielsen/pdp-client/proto/pdp/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// watcherBuffer is how many events a slow revision watcher can fall behind
+// before events are dropped for it.
+const watcherBuffer = 16
+
+// DecisionService implements the gRPC decision service on top of the permit
+// client and the policy composers.
+type DecisionService struct {
+	pdpv1.UnimplementedDecisionServiceServer
+
+	permit       *pdp.PermitClient
+	composer     *pdp.PolicyComposer
+	environments map[string]*pdp.PolicyComposer
+
+	mtx      sync.Mutex
+	watchers map[string]map[chan pdp.PolicyUpdateEvent]struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewDecisionService creates the service, and subscribes to the policy
+// updates of every environment for revision watchers.
+func NewDecisionService(permit *pdp.PermitClient, composer *pdp.PolicyComposer, environments map[string]*pdp.PolicyComposer) *DecisionService {
+	s := &DecisionService{
+		permit:       permit,
+		composer:     composer,
+		environments: environments,
+		watchers:     make(map[string]map[chan pdp.PolicyUpdateEvent]struct{}),
+		stop:         make(chan struct{}),
+	}
+
+	s.subscribe(pdp.DefaultEnvironment, composer)
+	for env, c := range environments {
+		s.subscribe(env, c)
+	}
+
+	return s
+}
+
+// Stop ends all revision watches. A graceful stop of the grpc server waits
+// for running streams, so it must be called first.
+func (s *DecisionService) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *DecisionService) Decide(ctx context.Context, req *pdpv1.DecisionRequest) (*pdpv1.DecisionResponse, error) {
+	return s.decide(ctx, req)
+}
+
+func (s *DecisionService) DecideBatch(ctx context.Context, req *pdpv1.BatchDecisionRequest) (*pdpv1.BatchDecisionResponse, error) {
+	response := &pdpv1.BatchDecisionResponse{Results: make([]*pdpv1.BatchDecisionResult, 0, len(req.Decisions))}
+	for _, d := range req.Decisions {
+		decision, err := s.decide(ctx, d)
+		if err != nil {
+			response.Results = append(response.Results, &pdpv1.BatchDecisionResult{Error: status.Convert(err).Message()})
+			continue
+		}
+
+		response.Results = append(response.Results, &pdpv1.BatchDecisionResult{Decision: decision})
+	}
+
+	return response, nil
+}
+
+func (s *DecisionService) GetPolicyStatus(ctx context.Context, req *pdpv1.PolicyStatusRequest) (*pdpv1.PolicyStatusResponse, error) {
+	composer, err := s.composerOf(req.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	return policyStatus(composer.Status()), nil
+}
+
+func (s *DecisionService) WatchRevisions(req *pdpv1.WatchRevisionsRequest, stream pdpv1.DecisionService_WatchRevisionsServer) error {
+	composer, err := s.composerOf(req.Environment)
+	if err != nil {
+		return err
+	}
+
+	events := make(chan pdp.PolicyUpdateEvent, watcherBuffer)
+	s.watch(req.Environment, events)
+	defer s.unwatch(req.Environment, events)
+
+	// start with the active revision, so watchers don't miss an update that
+	// happened before they subscribed
+	err = stream.Send(&pdpv1.RevisionEvent{
+		Timestamp:   timestamppb.Now(),
+		NewRevision: composer.Revision(),
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.stop:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		case event := <-events:
+			if err := stream.Send(revisionEvent(event)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// decide evaluates a decision, and maps the errors to grpc status codes.
+func (s *DecisionService) decide(ctx context.Context, req *pdpv1.DecisionRequest) (*pdpv1.DecisionResponse, error) {
+	if !s.permit.HasEnvironment(req.Environment) {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown environment: %s", req.Environment)
+	}
+
+	if !s.permit.EnvironmentReady(req.Environment) {
+		return nil, status.Error(codes.Unavailable, "PDP not ready: no policies loaded")
+	}
+
+	options := pdp.DecisionOptions{
+		Path:        req.Path,
+		Input:       req.Input.AsInterface(),
+		Environment: req.Environment,
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		options.RemoteAddr = p.Addr.String()
+	}
+
+	decision, err := s.permit.Decision(ctx, options)
+	if errors.Is(err, pdp.ErrUndefinedDecision) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		slog.Error("decision error", slog.String("error", err.Error()))
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	result, err := value(decision.Result)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pdpv1.DecisionResponse{DecisionId: decision.ID, Result: result}, nil
+}
+
+func (s *DecisionService) composerOf(env string) (*pdp.PolicyComposer, error) {
+	if env == pdp.DefaultEnvironment {
+		return s.composer, nil
+	}
+
+	composer, ok := s.environments[env]
+	if !ok {
+		return nil, status.Errorf(codes.InvalidArgument, "unknown environment: %s", env)
+	}
+
+	return composer, nil
+}
+
+// subscribe passes the policy updates of the environment to its watchers.
+// Events are dropped for watchers that fall too far behind, rather than
+// holding up policy updates.
+func (s *DecisionService) subscribe(env string, composer *pdp.PolicyComposer) {
+	composer.Subscribe(func(ctx context.Context, event pdp.PolicyUpdateEvent) {
+		s.mtx.Lock()
+		defer s.mtx.Unlock()
+
+		for events := range s.watchers[env] {
+			select {
+			case events <- event:
+			default:
+				slog.Warn("revision watcher too slow, dropping event", slog.String("environment", env), slog.String("revision", event.NewRevision))
+			}
+		}
+	})
+}
+
+func (s *DecisionService) watch(env string, events chan pdp.PolicyUpdateEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.watchers[env] == nil {
+		s.watchers[env] = make(map[chan pdp.PolicyUpdateEvent]struct{})
+	}
+	s.watchers[env][events] = struct{}{}
+}
+
+func (s *DecisionService) unwatch(env string, events chan pdp.PolicyUpdateEvent) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	delete(s.watchers[env], events)
+}
+
+// timestamp converts a time, leaving zero times unset.
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
@@ -1,6 +1,9 @@
 package util
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 func FormatURL(base string, endpoint string, useTLS bool) string {
 	prefix := "https://"
@@ -10,3 +13,16 @@ func FormatURL(base string, endpoint string, useTLS bool) string {
 
 	return fmt.Sprintf("%s%s%s", prefix, base, endpoint)
 }
+
+// SplitList splits a comma separated list, dropping empty items.
+func SplitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
@@ -0,0 +1,207 @@
+package pdp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+const defaultBundleKeyAlgorithm = "RS256"
+
+// ErrUnsignedBundle is returned for bundles without a .signatures.json file
+// when signatures are required.
+var ErrUnsignedBundle = errors.New("bundle is not signed")
+
+// verificationConfig converts the verification to the config of the OPA
+// bundle reader.
+func (v *BundleVerification) verificationConfig() (*bundle.VerificationConfig, error) {
+	if len(v.Keys) == 0 {
+		return nil, errors.New("no bundle verification keys configured")
+	}
+
+	keys := make(map[string]*bundle.KeyConfig, len(v.Keys))
+	for _, k := range v.Keys {
+		if k.ID == "" {
+			return nil, errors.New("bundle verification key without id")
+		}
+
+		if _, ok := keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate bundle verification key: %s", k.ID)
+		}
+
+		algorithm := k.Algorithm
+		if algorithm == "" {
+			algorithm = defaultBundleKeyAlgorithm
+		}
+
+		keys[k.ID] = &bundle.KeyConfig{Key: k.Key, Algorithm: algorithm, Scope: k.Scope}
+	}
+
+	return bundle.NewVerificationConfig(keys, v.KeyID, v.Scope, v.Exclude), nil
+}
+
+// signatureKeyID returns the id of the key that signed the bundle, from the
+// header of the first signature. The configured key id takes precedence, as
+// it does when verifying.
+func (v *BundleVerification) signatureKeyID(signatures bundle.SignaturesConfig) string {
+	if v.KeyID != "" || len(signatures.Signatures) == 0 {
+		return v.KeyID
+	}
+
+	header, _, _ := strings.Cut(signatures.Signatures[0], ".")
+	data, err := base64.RawURLEncoding.DecodeString(header)
+	if err != nil {
+		return ""
+	}
+
+	var h struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal(data, &h); err != nil {
+		return ""
+	}
+
+	return h.KeyID
+}
+
+// jsonWebKey holds the members of a JWK needed for signature verification.
+type jsonWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y"`
+	K         string `json:"k"`
+}
+
+// ParseJWKS reads the RSA, EC and symmetric keys of a JSON Web Key Set. Keys
+// for encryption are skipped. The algorithm defaults to RS256 for RSA keys,
+// the ES algorithm of the curve for EC keys and HS256 for symmetric keys.
+func ParseJWKS(data []byte) ([]BundleKey, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, errors.Join(err, errors.New("invalid jwks"))
+	}
+
+	var keys []BundleKey
+	for _, jwk := range set.Keys {
+		if jwk.Use == "enc" {
+			continue
+		}
+
+		key, err := jwk.bundleKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwk %s: %w", jwk.KeyID, err)
+		}
+
+		keys = append(keys, *key)
+	}
+
+	return keys, nil
+}
+
+func (jwk *jsonWebKey) bundleKey() (*BundleKey, error) {
+	key := &BundleKey{ID: jwk.KeyID, Algorithm: jwk.Algorithm}
+
+	var pub interface{}
+	switch jwk.KeyType {
+	case "RSA":
+		n, err := decodeJWKInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := decodeJWKInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+
+		pub = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		if key.Algorithm == "" {
+			key.Algorithm = "RS256"
+		}
+	case "EC":
+		curve, algorithm, err := jwkCurve(jwk.Curve)
+		if err != nil {
+			return nil, err
+		}
+
+		x, err := decodeJWKInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := decodeJWKInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		pub = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		if key.Algorithm == "" {
+			key.Algorithm = algorithm
+		}
+	case "oct":
+		secret, err := base64.RawURLEncoding.DecodeString(jwk.K)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Key = string(secret)
+		if key.Algorithm == "" {
+			key.Algorithm = "HS256"
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", jwk.KeyType)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Key = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	return key, nil
+}
+
+func jwkCurve(name string) (elliptic.Curve, string, error) {
+	switch name {
+	case "P-256":
+		return elliptic.P256(), "ES256", nil
+	case "P-384":
+		return elliptic.P384(), "ES384", nil
+	case "P-521":
+		return elliptic.P521(), "ES512", nil
+	}
+
+	return nil, "", fmt.Errorf("unsupported curve: %s", name)
+}
+
+func decodeJWKInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(bs), nil
+}
@@ -0,0 +1,282 @@
+package pdp
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/open-policy-agent/opa/bundle"
+)
+
+const (
+	defaultBundleTimeout = 30 * time.Second
+	bundleRetryDelay     = 5 * time.Second
+)
+
+// bundleSource provides the policies of an OPA bundle downloaded over http.
+// The bundle is downloaded again only when its ETag changed, and with long
+// polling the server holds the request until it did.
+type bundleSource struct {
+	endpoint   PolicyBundleEndpoint
+	httpClient *http.Client
+	mtx        sync.Mutex
+	loaded     bool
+	etag       string
+	revision   string
+	bundles    []PolicyBundle
+	signature  SignatureStatus
+}
+
+// NewBundleSource creates a source for the bundle at the endpoint.
+func NewBundleSource(endpoint PolicyBundleEndpoint) PolicySource {
+	if endpoint.Timeout <= 0 {
+		endpoint.Timeout = defaultBundleTimeout
+	}
+
+	// a long poll request is held by the server until the bundle changes,
+	// or the long poll timeout expires
+	client := defaultRoundTripperClient(0)
+	client.Transport.(*http.Transport).ResponseHeaderTimeout = endpoint.Timeout + endpoint.LongPollTimeout
+
+	return &bundleSource{
+		endpoint:   endpoint,
+		httpClient: client,
+	}
+}
+
+// Name returns the name of the bundle, or its url if it has none.
+func (s *bundleSource) Name() string {
+	if s.endpoint.Name != "" {
+		return s.endpoint.Name
+	}
+
+	return s.endpoint.Url
+}
+
+// Revision downloads the bundle if it changed, and returns the revision from
+// its manifest. With long polling, Watch downloads the bundle, and this only
+// downloads it if nothing was downloaded yet.
+func (s *bundleSource) Revision(ctx context.Context) (*PolicyRevision, error) {
+	s.mtx.Lock()
+	loaded := s.loaded
+	s.mtx.Unlock()
+
+	if !loaded || s.endpoint.LongPollTimeout <= 0 {
+		if _, err := s.download(ctx, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return &PolicyRevision{Ref: s.endpoint.Url, Hash: s.revision}, nil
+}
+
+// Load returns the policies of the last downloaded bundle.
+func (s *bundleSource) Load(ctx context.Context, revision *PolicyRevision) ([]PolicyBundle, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if !s.loaded {
+		return nil, errors.New("bundle not downloaded")
+	}
+
+	revision.Hash = s.revision
+	return s.bundles, nil
+}
+
+// Watch long polls the bundle, and notifies when it changed. It returns right
+// away if long polling isn't enabled.
+func (s *bundleSource) Watch(ctx context.Context, notify func()) error {
+	if s.endpoint.LongPollTimeout <= 0 {
+		return nil
+	}
+
+	for ctx.Err() == nil {
+		start := time.Now()
+		changed, err := s.download(ctx, s.endpoint.LongPollTimeout)
+		if err != nil && ctx.Err() != nil {
+			return nil
+		} else if err != nil {
+			slog.Warn("failed to long poll bundle", slog.String("source", s.Name()), slog.String("error", err.Error()))
+		}
+
+		if changed {
+			notify()
+			continue
+		}
+
+		// back off after errors, and if the server answered right away as it
+		// doesn't support long polling
+		if err != nil || time.Since(start) < time.Second {
+			select {
+			case <-ctx.Done():
+			case <-time.After(bundleRetryDelay):
+			}
+		}
+	}
+
+	return nil
+}
+
+// download fetches the bundle unless its ETag is unchanged, and reports
+// whether a new bundle was downloaded. A wait above zero asks the server to
+// hold the request until the bundle changes, for up to the wait.
+func (s *bundleSource) download(ctx context.Context, wait time.Duration) (bool, error) {
+	s.mtx.Lock()
+	etag := s.etag
+	s.mtx.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, s.endpoint.Timeout+wait)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.endpoint.Url, nil)
+	if err != nil {
+		return false, err
+	}
+
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	if wait > 0 {
+		req.Header.Set("Prefer", fmt.Sprintf("wait=%d", int(wait.Seconds())))
+	}
+
+	if s.endpoint.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+s.endpoint.BearerToken)
+	}
+
+	resp, err := s.httpClient.Do(req)
+	defer closeHttp(resp)
+	if err != nil {
+		return false, errors.Join(err, errors.New("failed to download bundle"))
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return false, nil
+	case http.StatusOK:
+	default:
+		return false, fmt.Errorf("failed to download bundle: status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return false, errors.Join(err, errors.New("failed to download bundle"))
+	}
+
+	revision, bundles, err := s.read(body)
+	if err != nil {
+		return false, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	changed := !s.loaded || revision != s.revision
+	s.loaded = true
+	s.etag = resp.Header.Get("ETag")
+	s.revision = revision
+	s.bundles = bundles
+	return changed, nil
+}
+
+// read parses a bundle, and verifies its signature if required. The reader
+// refuses modules outside the roots of the manifest, and files that are
+// modified or not covered by the signature. The revision is the one in the
+// manifest, followed by a hash of the bundle so a bundle republished without
+// a new revision is loaded too.
+func (s *bundleSource) read(body []byte) (string, []PolicyBundle, error) {
+	sum := sha256.Sum256(body)
+	revision := hex.EncodeToString(sum[:])
+
+	reader := bundle.NewReader(bytes.NewReader(body))
+	verification := s.endpoint.Verification
+	if verification != nil {
+		config, err := verification.verificationConfig()
+		if err != nil {
+			return "", nil, err
+		}
+
+		reader = reader.WithBundleVerificationConfig(config)
+	} else {
+		reader = reader.WithSkipBundleVerification(true)
+	}
+
+	b, err := reader.Read()
+	if verification != nil {
+		if err == nil && len(b.Signatures.Signatures) == 0 {
+			err = ErrUnsignedBundle
+		}
+
+		s.recordSignature(revision, verification.signatureKeyID(b.Signatures), err)
+	}
+
+	if err != nil {
+		return "", nil, errors.Join(err, errors.New("invalid bundle"))
+	}
+
+	// only policies are loaded, the data documents of the bundle are skipped
+	// rather than failing the update, as many OPA bundles carry some
+	if len(b.Data) > 0 {
+		slog.Warn("ignoring data documents of policy bundle, only policies are loaded", slog.String("source", s.Name()), slog.Int("documents", len(b.Data)))
+	}
+
+	var bundles []PolicyBundle
+	for _, m := range b.Modules {
+		bundles = append(bundles, PolicyBundle{
+			Name: strings.TrimSuffix(strings.TrimPrefix(m.Path, "/"), ".rego"),
+			Data: m.Raw,
+		})
+	}
+
+	if b.Manifest.Revision != "" {
+		revision = b.Manifest.Revision + "@" + revision[:12]
+	}
+
+	return revision, bundles, nil
+}
+
+// recordSignature records the outcome of verifying the bundle with the
+// hash in the signature status.
+func (s *bundleSource) recordSignature(hash string, signer string, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err != nil {
+		s.signature.Refusals++
+		s.signature.LastRefusal = err.Error()
+		s.signature.LastRefusedHash = hash
+		s.signature.LastRefusalTime = time.Now().UTC()
+		slog.Error("refused policy bundle", slog.String("source", s.Name()), slog.String("hash", hash), slog.String("error", err.Error()))
+		return
+	}
+
+	s.signature.Verifications++
+	s.signature.Signer = signer
+	s.signature.VerifiedHash = hash
+	slog.Info("verified policy bundle", slog.String("source", s.Name()), slog.String("signer", signer))
+}
+
+// SignatureStatus reports the outcome of the signature verification of the
+// bundles downloaded so far.
+func (s *bundleSource) SignatureStatus() SignatureStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	status := s.signature
+	status.Required = s.endpoint.Verification != nil
+	return status
+}
@@ -0,0 +1,252 @@
+package pdp
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// bundleArchive builds a bundle.tar.gz with the files.
+func bundleArchive(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o600, Size: int64(len(content))})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// bundleServer serves bundles with an ETag, and answers a matching
+// If-None-Match with 304. With a wait in the Prefer header, a request for an
+// unchanged bundle is held until the bundle is replaced.
+type bundleServer struct {
+	mtx       sync.Mutex
+	etag      string
+	body      []byte
+	changed   chan struct{}
+	downloads atomic.Int32
+	held      atomic.Int32
+	prefer    atomic.Value
+}
+
+func newBundleServer(t *testing.T, etag string, body []byte) (*bundleServer, *httptest.Server) {
+	s := &bundleServer{etag: etag, body: body, changed: make(chan struct{})}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	return s, server
+}
+
+func (s *bundleServer) replace(etag string, body []byte) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.etag, s.body = etag, body
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *bundleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.prefer.Store(r.Header.Get("Prefer"))
+
+	s.mtx.Lock()
+	etag, body, changed := s.etag, s.body, s.changed
+	s.mtx.Unlock()
+
+	if r.Header.Get("If-None-Match") == etag {
+		if !strings.HasPrefix(r.Header.Get("Prefer"), "wait=") {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		s.held.Add(1)
+		select {
+		case <-changed:
+		case <-r.Context().Done():
+			return
+		}
+
+		s.mtx.Lock()
+		etag, body = s.etag, s.body
+		s.mtx.Unlock()
+	}
+
+	s.downloads.Add(1)
+	w.Header().Set("ETag", etag)
+	w.Write(body)
+}
+
+func TestBundleSourceNotModified(t *testing.T) {
+	body := bundleArchive(t, map[string]string{
+		"/app/policy.rego": "package app\n\nallow := true\n",
+	})
+	server, ts := newBundleServer(t, `"v1"`, body)
+
+	source := NewBundleSource(PolicyBundleEndpoint{Url: ts.URL})
+	first, err := source.Revision(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := source.Revision(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := server.downloads.Load(); got != 1 {
+		t.Fatalf("expected the bundle to be downloaded once, got %d downloads", got)
+	}
+
+	if first.Hash != second.Hash {
+		t.Fatalf("expected an unchanged revision, got %s and %s", first.Hash, second.Hash)
+	}
+
+	bundles, err := source.Load(context.Background(), second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bundles) != 1 || bundles[0].Name != "app/policy" {
+		t.Fatalf("unexpected policies: %+v", bundles)
+	}
+}
+
+func TestBundleSourceLongPoll(t *testing.T) {
+	server, ts := newBundleServer(t, `"v1"`, bundleArchive(t, map[string]string{
+		"/.manifest":       `{"revision": "v1"}`,
+		"/app/policy.rego": "package app\n\nallow := false\n",
+	}))
+
+	source := NewBundleSource(PolicyBundleEndpoint{Url: ts.URL, LongPollTimeout: 10 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notified := make(chan struct{}, 4)
+	go source.(PolicyWatcher).Watch(ctx, func() { notified <- struct{}{} })
+
+	waitNotified(t, notified)
+	revision, err := source.Revision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(revision.Hash, "v1@") {
+		t.Fatalf("expected the first revision, got %s", revision.Hash)
+	}
+
+	// the watcher is now held by the server until the bundle changes
+	deadline := time.Now().Add(5 * time.Second)
+	for server.held.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a long poll request to be held")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	server.replace(`"v2"`, bundleArchive(t, map[string]string{
+		"/.manifest":       `{"revision": "v2"}`,
+		"/app/policy.rego": "package app\n\nallow := true\n",
+	}))
+
+	if prefer := server.prefer.Load(); prefer != "wait=10" {
+		t.Fatalf("expected Prefer wait=10, got %v", prefer)
+	}
+
+	waitNotified(t, notified)
+	revision, err = source.Revision(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(revision.Hash, "v2@") {
+		t.Fatalf("expected the changed revision, got %s", revision.Hash)
+	}
+
+	if got := server.downloads.Load(); got != 2 {
+		t.Fatalf("expected 2 downloads, got %d", got)
+	}
+}
+
+func waitNotified(t *testing.T, notified chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected a change notification")
+	}
+}
+
+func TestBundleSourceManifestRevision(t *testing.T) {
+	_, ts := newBundleServer(t, `"v1"`, bundleArchive(t, map[string]string{
+		"/.manifest":       `{"revision": "release-42", "roots": ["app"]}`,
+		"/app/policy.rego": "package app\n\nallow := true\n",
+		"/app/data.json":   `{"admins": ["alice"]}`,
+	}))
+
+	source := NewBundleSource(PolicyBundleEndpoint{Url: ts.URL})
+	revision, err := source.Revision(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name, hash, ok := strings.Cut(revision.Hash, "@")
+	if !ok || name != "release-42" || len(hash) != 12 {
+		t.Fatalf("expected the manifest revision with a hash, got %s", revision.Hash)
+	}
+
+	// the data document is skipped, the policies are still loaded
+	bundles, err := source.Load(context.Background(), revision)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(bundles) != 1 {
+		t.Fatalf("expected the policy to be loaded, got %+v", bundles)
+	}
+}
+
+func TestBundleSourceManifestRoots(t *testing.T) {
+	_, ts := newBundleServer(t, `"v1"`, bundleArchive(t, map[string]string{
+		"/.manifest":         `{"roots": ["app"]}`,
+		"/app/policy.rego":   "package app\n\nallow := true\n",
+		"/other/policy.rego": "package other\n\nallow := true\n",
+	}))
+
+	source := NewBundleSource(PolicyBundleEndpoint{Url: ts.URL})
+	_, err := source.Revision(context.Background())
+	if err == nil {
+		t.Fatal("expected a module outside the manifest roots to be refused")
+	}
+
+	if !strings.Contains(err.Error(), "do not permit") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
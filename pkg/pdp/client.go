@@ -5,24 +5,50 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/open-policy-agent/opa/ast"
+	"github.com/open-policy-agent/opa/metrics"
 	"github.com/open-policy-agent/opa/rego"
 	"github.com/open-policy-agent/opa/storage"
 	"github.com/open-policy-agent/opa/storage/inmem"
+	"github.com/open-policy-agent/opa/topdown"
+	"github.com/open-policy-agent/opa/topdown/lineage"
 )
 
+// DefaultEnvironment is the environment of decisions that don't name one.
+const DefaultEnvironment = ""
+
+// ErrUndefinedDecision is returned when the policies don't define the
+// decision.
+var ErrUndefinedDecision = errors.New("decision was undefined")
+
+// ErrUnknownEnvironment is returned for decisions and activations in an
+// environment that isn't configured.
+var ErrUnknownEnvironment = errors.New("unknown environment")
+
 type PermitClient struct {
-	logger         *decisionLogger
-	queryCache     *queryCache
-	store          storage.Store
-	policiesLoaded bool
+	logger    *decisionLogger
+	snapshots map[string]*policySnapshot
+}
+
+// policySnapshot holds the policies of one environment, each loaded from its
+// own branch. The revision is swapped together with the policies, so every
+// decision is stamped with the revision it was evaluated against.
+type policySnapshot struct {
+	queryCache *queryCache
+	store      storage.Store
+	loaded     atomic.Bool
+	mtx        sync.RWMutex
+	revision   string
 }
 
 type PermitConfig struct {
-	Logger DecisionLogConfig
+	Logger       DecisionLogConfig
+	Environments []string // names of the environments besides the default one
 }
 
 func New(config *PermitConfig) (*PermitClient, error) {
@@ -32,16 +58,39 @@ func New(config *PermitConfig) (*PermitClient, error) {
 	}
 
 	permit := &PermitClient{
-		logger:         logger,
-		store:          inmem.New(),
-		queryCache:     newQueryCache(),
-		policiesLoaded: false,
+		logger:    logger,
+		snapshots: map[string]*policySnapshot{DefaultEnvironment: newPolicySnapshot()},
+	}
+
+	for _, env := range config.Environments {
+		if _, ok := permit.snapshots[env]; ok {
+			return nil, fmt.Errorf("duplicate environment: %q", env)
+		}
+		permit.snapshots[env] = newPolicySnapshot()
 	}
 
 	permit.logger.Start()
 	return permit, nil
 }
 
+func newPolicySnapshot() *policySnapshot {
+	return &policySnapshot{
+		store:      inmem.New(),
+		queryCache: newQueryCache(),
+	}
+}
+
+// snapshot returns the policies of the environment. The set of environments
+// is fixed when the client is created, so no locking is needed.
+func (p *PermitClient) snapshot(env string) (*policySnapshot, error) {
+	snap, ok := p.snapshots[env]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownEnvironment, env)
+	}
+
+	return snap, nil
+}
+
 func (p *PermitClient) Close(ctx context.Context) error {
 	return p.logger.Stop(ctx)
 }
@@ -52,15 +101,78 @@ func (p *PermitClient) Decision(ctx context.Context, options DecisionOptions) (*
 		return nil, err
 	}
 
-	r, err := parseDataPath(options.Path)
+	snap, err := p.snapshot(options.Environment)
 	if err != nil {
 		return nil, err
 	}
 
-	pq, err := p.queryCache.Get(r.String(), func(s string) (*rego.PreparedEvalQuery, error) {
+	err = snap.decision(ctx, options, result)
+	if err != nil {
+		return nil, err
+	}
+
+	err = errors.Join(err, p.logger.Log(*result))
+	return result, err
+}
+
+func (p *PermitClient) Activate(ctx context.Context, path string, policyData string) error {
+	snap := p.snapshots[DefaultEnvironment]
+	txn, err := snap.store.NewTransaction(ctx, storage.TransactionParams{Write: true})
+	if err != nil {
+		return err
+	}
+
+	err = snap.store.UpsertPolicy(ctx, txn, path, []byte(policyData))
+	if err != nil {
+		return err
+	}
+
+	err = snap.store.Commit(ctx, txn)
+	if err != nil {
+		return err
+	}
+
+	snap.queryCache.Clear()
+	snap.loaded.Store(true)
+	return err
+}
+
+// ActivateBundles replaces all active policies of the default environment
+// with the bundles, without a revision, see ActivateEnvironment.
+func (p *PermitClient) ActivateBundles(ctx context.Context, bundles []PolicyBundle) error {
+	return p.ActivateEnvironment(ctx, DefaultEnvironment, "", bundles)
+}
+
+// ActivateEnvironment replaces all active policies of the environment with
+// the bundles in a single transaction, so decisions never see a partial set.
+// The bundles are compiled first, and nothing is changed if they don't
+// compile. Decisions are stamped with the revision, e.g. the composite
+// revision of a PolicyComposer, until the next activation.
+func (p *PermitClient) ActivateEnvironment(ctx context.Context, env string, revision string, bundles []PolicyBundle) error {
+	snap, err := p.snapshot(env)
+	if err != nil {
+		return err
+	}
+
+	return snap.activate(ctx, revision, bundles)
+}
+
+// decision evaluates the decision against the policies of the snapshot, and
+// fills in the result.
+func (s *policySnapshot) decision(ctx context.Context, options DecisionOptions, result *DecisionResult) error {
+	r, err := parseDataPath(options.Path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := explain(options.Explain, nil); err != nil {
+		return err
+	}
+
+	pq, err := s.queryCache.Get(r.String(), func(query string) (*rego.PreparedEvalQuery, error) {
 		pq, err := rego.New(
-			rego.Query(s),
-			rego.Store(p.store),
+			rego.Query(query),
+			rego.Store(s.store),
 		).PrepareForEval(ctx)
 		if err != nil {
 			return nil, err
@@ -69,55 +181,161 @@ func (p *PermitClient) Decision(ctx context.Context, options DecisionOptions) (*
 		return &pq, nil
 	})
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	ts := time.Now().UTC()
-	rs, err := pq.Eval(
-		ctx,
+	evalOptions := []rego.EvalOption{
 		rego.EvalTime(ts),
 		rego.EvalInput(options.Input),
-	)
+	}
+
+	var tracer *topdown.BufferTracer
+	if options.Explain != "" {
+		tracer = topdown.NewBufferTracer()
+		evalOptions = append(evalOptions, rego.EvalQueryTracer(tracer))
+	}
+
+	var m metrics.Metrics
+	if options.Metrics {
+		m = metrics.New()
+		evalOptions = append(evalOptions, rego.EvalMetrics(m))
+	}
 
+	// the policies can't be replaced during evaluation, so the revision is the
+	// one the decision was made with
+	s.mtx.RLock()
+	rs, err := pq.Eval(ctx, evalOptions...)
+	revision := s.revision
+	s.mtx.RUnlock()
 	if err != nil {
-		return nil, err
+		return err
 	} else if len(rs) == 0 {
-		return nil, errors.New(fmt.Sprintf("%v decision was undefined", options.Path))
+		return fmt.Errorf("%v %w", options.Path, ErrUndefinedDecision)
+	}
+
+	if tracer != nil {
+		result.Explanation, err = explain(options.Explain, *tracer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m != nil {
+		result.Metrics = m.All()
 	}
 
 	result.Timestamp = ts
 	result.Result = rs[0].Expressions[0].Value
 	result.Input = options.Input
 	result.Path = options.Path
+	result.Environment = options.Environment
+	result.Revision = revision
 	result.RequestedBy = options.RemoteAddr
 
-	err = errors.Join(err, p.logger.Log(*result))
-	return result, err
+	return nil
 }
 
-func (p *PermitClient) Activate(ctx context.Context, path string, policyData string) error {
-	txn, err := p.store.NewTransaction(ctx, storage.TransactionParams{Write: true})
+// activate replaces all policies of the snapshot with the bundles in a single
+// transaction, and records their revision. The bundles are compiled first,
+// and nothing is changed if they don't compile.
+func (s *policySnapshot) activate(ctx context.Context, revision string, bundles []PolicyBundle) error {
+	modules := make(map[string]*ast.Module, len(bundles))
+	for _, b := range bundles {
+		module, err := ast.ParseModule(b.Name, string(b.Data))
+		if err != nil {
+			return err
+		}
+		modules[b.Name] = module
+	}
+
+	compiler := ast.NewCompiler()
+	if compiler.Compile(modules); compiler.Failed() {
+		return compiler.Errors
+	}
+
+	txn, err := s.store.NewTransaction(ctx, storage.TransactionParams{Write: true})
 	if err != nil {
 		return err
 	}
 
-	err = p.store.UpsertPolicy(ctx, txn, path, []byte(policyData))
+	err = s.replacePolicies(ctx, txn, bundles)
 	if err != nil {
+		s.store.Abort(ctx, txn)
 		return err
 	}
 
-	err = p.store.Commit(ctx, txn)
+	s.mtx.Lock()
+	err = s.store.Commit(ctx, txn)
+	if err == nil {
+		s.revision = revision
+	}
+	s.mtx.Unlock()
 	if err != nil {
 		return err
 	}
 
-	p.queryCache.Clear()
-	p.policiesLoaded = true
-	return err
+	s.queryCache.Clear()
+	s.loaded.Store(true)
+	return nil
+}
+
+func (s *policySnapshot) replacePolicies(ctx context.Context, txn storage.Transaction, bundles []PolicyBundle) error {
+	existing, err := s.store.ListPolicies(ctx, txn)
+	if err != nil {
+		return err
+	}
+
+	keep := make(map[string]struct{}, len(bundles))
+	for _, b := range bundles {
+		keep[b.Name] = struct{}{}
+		err = s.store.UpsertPolicy(ctx, txn, b.Name, b.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, id := range existing {
+		if _, ok := keep[id]; ok {
+			continue
+		}
+
+		err = s.store.DeletePolicy(ctx, txn, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (p *PermitClient) Ready() bool {
-	return p.policiesLoaded
+	return p.EnvironmentReady(DefaultEnvironment)
+}
+
+// HasEnvironment reports whether the environment is configured.
+func (p *PermitClient) HasEnvironment(env string) bool {
+	_, ok := p.snapshots[env]
+	return ok
+}
+
+// EnvironmentReady reports whether policies were activated in the
+// environment.
+func (p *PermitClient) EnvironmentReady(env string) bool {
+	snap, ok := p.snapshots[env]
+	return ok && snap.loaded.Load()
+}
+
+func (p *PermitClient) LoggerStatus() DecisionLoggerStatus {
+	return p.logger.Status()
+}
+
+func (p *PermitClient) DeadLetters() ([]DeadLetterEntry, error) {
+	return p.logger.DeadLetters()
+}
+
+func (p *PermitClient) ReplayDeadLetters(ctx context.Context) (int, error) {
+	return p.logger.ReplayDeadLetters(ctx)
 }
 
 func newDecisionResult() (*DecisionResult, error) {
@@ -130,6 +348,25 @@ func newDecisionResult() (*DecisionResult, error) {
 	return result, nil
 }
 
+// explain filters the trace of a decision for the explain mode: notes, fails,
+// full or debug, like the OPA Data API.
+func explain(mode string, trace []*topdown.Event) ([]*topdown.Event, error) {
+	switch mode {
+	case "":
+		return nil, nil
+	case "notes":
+		return lineage.Notes(trace), nil
+	case "fails":
+		return lineage.Fails(trace), nil
+	case "full":
+		return lineage.Full(trace), nil
+	case "debug":
+		return lineage.Debug(trace), nil
+	}
+
+	return nil, fmt.Errorf("invalid explain mode: %s", mode)
+}
+
 func parseDataPath(s string) (ast.Ref, error) {
 	s = "/" + strings.TrimPrefix(s, "/")
 
@@ -0,0 +1,183 @@
+package pdp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+)
+
+const defaultDirectoryDebounce = 500 * time.Millisecond
+
+// directorySource provides the policies in a directory on the local
+// filesystem, and watches it for changes.
+type directorySource struct {
+	dir     PolicyDirectory
+	mtx     sync.Mutex
+	hash    string
+	bundles []PolicyBundle
+}
+
+// NewDirectorySource creates a source for the policies in the directory.
+func NewDirectorySource(dir PolicyDirectory) PolicySource {
+	if dir.Debounce <= 0 {
+		dir.Debounce = defaultDirectoryDebounce
+	}
+
+	return &directorySource{dir: dir}
+}
+
+// Name returns the name of the directory, or its path if it has none.
+func (s *directorySource) Name() string {
+	if s.dir.Name != "" {
+		return s.dir.Name
+	}
+
+	return s.dir.Path
+}
+
+// Revision reads the policies in the directory, and hashes them.
+func (s *directorySource) Revision(ctx context.Context) (*PolicyRevision, error) {
+	hash, _, err := s.scan()
+	if err != nil {
+		return nil, err
+	}
+
+	return &PolicyRevision{Ref: s.dir.Path, Hash: hash}, nil
+}
+
+// Load returns the policies read by Revision, or reads them again if the
+// directory changed in the meantime.
+func (s *directorySource) Load(ctx context.Context, revision *PolicyRevision) ([]PolicyBundle, error) {
+	s.mtx.Lock()
+	hash, bundles := s.hash, s.bundles
+	s.mtx.Unlock()
+
+	if hash != revision.Hash {
+		var err error
+		hash, bundles, err = s.scan()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	revision.Hash = hash
+	return bundles, nil
+}
+
+// scan reads the policies in the directory. The path is resolved first, so a
+// directory replaced by swapping a symlink is read consistently.
+func (s *directorySource) scan() (string, []PolicyBundle, error) {
+	root, err := filepath.EvalSymlinks(s.dir.Path)
+	if err != nil {
+		return "", nil, errors.Join(err, errors.New("failed to resolve policy directory"))
+	}
+
+	bundles, err := discoverBundles(osfs.New(root), "", s.dir.Include, s.dir.Exclude)
+	if err != nil {
+		return "", nil, err
+	}
+
+	h := sha256.New()
+	for _, b := range bundles {
+		h.Write([]byte(b.Name))
+		h.Write([]byte{0})
+		h.Write(b.Data)
+		h.Write([]byte{0})
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.hash = hash
+	s.bundles = bundles
+	return hash, bundles, nil
+}
+
+// Watch notifies when files in the directory change, once the changes have
+// settled for the debounce duration. ConfigMap volumes are updated by
+// swapping the ..data symlink in the directory, and a directory that is a
+// symlink itself is replaced in its parent, so both are watched.
+func (s *directorySource) Watch(ctx context.Context, notify func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	err = s.watchDirs(watcher)
+	if err != nil {
+		return err
+	}
+
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			debounce = time.After(s.dir.Debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("policy directory watch error", slog.String("source", s.Name()), slog.String("error", err.Error()))
+		case <-debounce:
+			debounce = nil
+
+			// directories might have been created or replaced
+			err := s.watchDirs(watcher)
+			if err != nil {
+				slog.Warn("failed to watch policy directory", slog.String("source", s.Name()), slog.String("error", err.Error()))
+			}
+
+			notify()
+		}
+	}
+}
+
+// watchDirs adds the directory and every directory below it to the watcher.
+func (s *directorySource) watchDirs(watcher *fsnotify.Watcher) error {
+	if fi, err := os.Lstat(s.dir.Path); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		if err := watcher.Add(filepath.Dir(s.dir.Path)); err != nil {
+			return err
+		}
+	}
+
+	if err := watcher.Add(s.dir.Path); err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(s.dir.Path)
+	if err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == root {
+			return nil
+		}
+
+		if d.Name() == git.GitDirName || strings.HasPrefix(d.Name(), "..") {
+			return filepath.SkipDir
+		}
+
+		return watcher.Add(path)
+	})
+}
@@ -0,0 +1,216 @@
+package pdp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	AuthDetect = ""      // select the method from the url and the configured credentials
+	AuthSSH    = "ssh"   // ssh with a private key
+	AuthBasic  = "basic" // https with username and password
+	AuthToken  = "token" // https with a personal access or deploy token
+	AuthNone   = "none"  // anonymous access
+
+	defaultTokenUsername = "x-access-token"
+)
+
+// PolicyAuth holds the credentials used to access a policy repository.
+type PolicyAuth struct {
+	Method           string   // one of the Auth* methods, defaults to detecting it
+	SSHKey           []byte   // private key for ssh
+	SSHKeyFile       string   // path to the private key for ssh, used if SSHKey is empty
+	SSHKeyPassphrase string   // passphrase of an encrypted private key
+	KnownHostsFile   string   // known_hosts file the ssh host key is verified against
+	KnownHosts       []string // pinned ssh host keys, in known_hosts format (e.g. "github.com ssh-ed25519 AAAA...")
+	Username         string   // username for basic auth, or for token auth if the server requires one (e.g. gitlab deploy tokens)
+	Password         string   // password for basic auth
+	Token            string   // token for token auth
+}
+
+// method resolves the configured method, detecting it from the url scheme and
+// the credentials that are set if needed.
+func (a *PolicyAuth) method(url string) string {
+	if a.Method != AuthDetect {
+		return a.Method
+	}
+
+	if isHTTPURL(url) {
+		switch {
+		case a.Token != "":
+			return AuthToken
+		case a.Username != "" || a.Password != "":
+			return AuthBasic
+		}
+
+		return AuthNone
+	}
+
+	if len(a.SSHKey) > 0 || a.SSHKeyFile != "" {
+		return AuthSSH
+	}
+
+	return AuthNone
+}
+
+// transportAuth builds the go-git auth method for the repository url. It
+// returns nil for anonymous access.
+func (a *PolicyAuth) transportAuth(url string) (transport.AuthMethod, error) {
+	method := a.method(url)
+	if method != AuthSSH && method != AuthNone && !isHTTPURL(url) {
+		return nil, fmt.Errorf("%s auth requires a http(s) repository url", method)
+	}
+
+	switch method {
+	case AuthNone:
+		return nil, nil
+	case AuthSSH:
+		var authKey *ssh.PublicKeys
+		var err error
+		if len(a.SSHKey) == 0 && a.SSHKeyFile != "" {
+			authKey, err = ssh.NewPublicKeysFromFile("git", a.SSHKeyFile, a.SSHKeyPassphrase)
+		} else {
+			authKey, err = ssh.NewPublicKeys("git", a.SSHKey, a.SSHKeyPassphrase)
+		}
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to get authkey"))
+		}
+
+		callback, err := a.hostKeyCallback()
+		if err != nil {
+			return nil, errors.Join(err, errors.New("failed to load known hosts"))
+		}
+
+		authKey.HostKeyCallback = callback
+		return authKey, nil
+	case AuthBasic:
+		return &http.BasicAuth{Username: a.Username, Password: a.Password}, nil
+	case AuthToken:
+		// git servers expect tokens as the basic auth password, the username
+		// is ignored by most of them but must not be empty
+		username := a.Username
+		if username == "" {
+			username = defaultTokenUsername
+		}
+
+		return &http.BasicAuth{Username: username, Password: a.Token}, nil
+	}
+
+	return nil, fmt.Errorf("unknown repository auth method: %s", method)
+}
+
+// hostKeyCallback verifies the ssh host key against the pinned keys and the
+// known_hosts file. An unknown or changed host key is always an error. If
+// neither is configured it returns nil, so go-git falls back to the default
+// known_hosts files of the user.
+func (a *PolicyAuth) hostKeyCallback() (gossh.HostKeyCallback, error) {
+	// blank lines pin nothing, and without any pins the default known_hosts
+	// files of the user are used
+	pinnedHosts := false
+	for _, line := range a.KnownHosts {
+		pinnedHosts = pinnedHosts || strings.TrimSpace(line) != ""
+	}
+
+	if !pinnedHosts && a.KnownHostsFile == "" {
+		return nil, nil
+	}
+
+	pinned, err := parseKnownHosts(a.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	var fileCallback gossh.HostKeyCallback
+	if a.KnownHostsFile != "" {
+		fileCallback, err = knownhosts.New(a.KnownHostsFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return func(hostname string, remote net.Addr, key gossh.PublicKey) error {
+		if pinned.match(hostname, remote, key) {
+			return nil
+		}
+
+		if fileCallback != nil {
+			return fileCallback(hostname, remote, key)
+		}
+
+		return fmt.Errorf("ssh host key for %s is not pinned: %s %s", hostname, key.Type(), gossh.FingerprintSHA256(key))
+	}, nil
+}
+
+type knownHost struct {
+	hosts []string
+	key   gossh.PublicKey
+}
+
+type knownHostList []knownHost
+
+// parseKnownHosts parses pinned keys in known_hosts format. Hashed host names
+// and markers are not supported for pinned keys.
+func parseKnownHosts(lines []string) (knownHostList, error) {
+	var list knownHostList
+	for _, line := range lines {
+		rest := []byte(line)
+		for len(bytes.TrimSpace(rest)) > 0 {
+			marker, hosts, key, _, next, err := gossh.ParseKnownHosts(rest)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+
+			if marker != "" {
+				return nil, fmt.Errorf("unsupported marker in pinned host key: %s", marker)
+			}
+
+			for i := range hosts {
+				hosts[i] = knownhosts.Normalize(hosts[i])
+			}
+
+			list = append(list, knownHost{hosts: hosts, key: key})
+			rest = next
+		}
+	}
+
+	return list, nil
+}
+
+func (l knownHostList) match(hostname string, remote net.Addr, key gossh.PublicKey) bool {
+	candidates := []string{knownhosts.Normalize(hostname)}
+	if remote != nil {
+		candidates = append(candidates, knownhosts.Normalize(remote.String()))
+	}
+
+	for _, known := range l {
+		if !bytes.Equal(known.key.Marshal(), key.Marshal()) {
+			continue
+		}
+
+		for _, host := range known.hosts {
+			for _, candidate := range candidates {
+				if host == candidate {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func isHTTPURL(url string) bool {
+	return strings.HasPrefix(url, "https://") || strings.HasPrefix(url, "http://")
+}
@@ -0,0 +1,211 @@
+package pdp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"log/slog"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+const (
+	cacheRemoteName = "origin"
+	cacheStateFile  = "pdp-active.json"
+)
+
+// cacheState records the revision that was last activated from the cache.
+type cacheState struct {
+	Ref  string `json:"ref"`
+	Hash string `json:"hash"`
+}
+
+// loadCached loads the revision that was last activated from the on-disk
+// cache, without contacting the remote. This lets the PDP become ready while
+// the git server is unavailable. It returns no revision if no cache is
+// configured or nothing was activated yet.
+func (s *gitSource) loadCached(ctx context.Context) (*PolicyRevision, []PolicyBundle, error) {
+	if s.project.CacheDir == "" {
+		return nil, nil, nil
+	}
+
+	s.repoMtx.Lock()
+	defer s.repoMtx.Unlock()
+
+	state, err := s.readCacheState()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	repo, err := git.PlainOpen(s.project.CacheDir)
+	if err != nil {
+		return nil, nil, errors.Join(err, errors.New("failed to open repository cache"))
+	}
+
+	ref := &resolvedRef{Name: plumbing.ReferenceName(state.Ref), Hash: state.Hash}
+	if err := checkoutCommit(repo, ref.Hash); err != nil {
+		return nil, nil, err
+	}
+
+	bundles, err := s.loadBundles(repo, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	revision := ref.revision()
+	revision.Commit = commitInfo(repo, ref.Hash)
+	return revision, bundles, nil
+}
+
+// fetchCached updates the on-disk cache with the objects needed for the
+// revision, and checks it out. Only objects missing from the cache are
+// fetched.
+func (s *gitSource) fetchCached(ref *resolvedRef, auth transport.AuthMethod) (*git.Repository, error) {
+	repo, err := s.openCache()
+	if err != nil {
+		return nil, err
+	}
+
+	var refSpecs []config.RefSpec
+	if ref.Name != "" {
+		refSpecs = []config.RefSpec{config.RefSpec(fmt.Sprintf("+%s:%s", ref.Name, ref.Name))}
+	} else if _, err := repo.CommitObject(plumbing.NewHash(ref.Hash)); err != nil {
+		// a pinned commit we don't have yet, fetch all branches to find it
+		refSpecs = []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+	}
+
+	if len(refSpecs) > 0 {
+		err = repo.Fetch(&git.FetchOptions{
+			RemoteName: cacheRemoteName,
+			RefSpecs:   refSpecs,
+			Auth:       auth,
+			Tags:       git.NoTags,
+			Force:      true,
+		})
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil, errors.Join(err, errors.New("failed to fetch"))
+		}
+	}
+
+	// the ref might have moved since it was resolved, make sure we report
+	// what we actually loaded
+	if ref.Name != "" {
+		local, err := repo.Reference(ref.Name, true)
+		if err != nil {
+			return nil, errors.Join(err, fmt.Errorf("failed to get %s", ref.Name))
+		}
+
+		hash := local.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			hash = tag.Target
+		}
+
+		ref.Hash = hash.String()
+	}
+
+	if err := checkoutCommit(repo, ref.Hash); err != nil {
+		return nil, err
+	}
+
+	return repo, nil
+}
+
+// openCache opens the cache repository, creating it if needed, and points its
+// remote at the project url.
+func (s *gitSource) openCache() (*git.Repository, error) {
+	repo, err := git.PlainOpen(s.project.CacheDir)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		repo, err = git.PlainInit(s.project.CacheDir, false)
+	}
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to open repository cache"))
+	}
+
+	remote, err := repo.Remote(cacheRemoteName)
+	if err == nil && len(remote.Config().URLs) == 1 && remote.Config().URLs[0] == s.project.Url {
+		return repo, nil
+	}
+
+	if err == nil {
+		if err := repo.DeleteRemote(cacheRemoteName); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: cacheRemoteName,
+		URLs: []string{s.project.Url},
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to configure repository cache"))
+	}
+
+	return repo, nil
+}
+
+// saveCached records the activated revision, so it can be loaded by
+// loadCached after a restart. An empty revision clears it.
+func (s *gitSource) saveCached(revision *PolicyRevision) {
+	if s.project.CacheDir == "" {
+		return
+	}
+
+	if revision.Hash == "" {
+		err := os.Remove(s.cacheStatePath())
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("failed to clear repository cache state", slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	ref := resolvedRevision(revision)
+	data, err := json.Marshal(cacheState{Ref: ref.Name.String(), Hash: ref.Hash})
+	if err == nil {
+		err = os.WriteFile(s.cacheStatePath(), data, 0o640)
+	}
+
+	if err != nil {
+		slog.Warn("failed to save repository cache state", slog.String("error", err.Error()))
+	}
+}
+
+func (s *gitSource) readCacheState() (*cacheState, error) {
+	data, err := os.ReadFile(s.cacheStatePath())
+	if err != nil {
+		return nil, err
+	}
+
+	var state cacheState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Join(err, errors.New("invalid repository cache state"))
+	}
+
+	return &state, nil
+}
+
+func (s *gitSource) cacheStatePath() string {
+	return filepath.Join(s.project.CacheDir, git.GitDirName, cacheStateFile)
+}
+
+func checkoutCommit(repo *git.Repository, hash string) error {
+	wt, err := repo.Worktree()
+	if err != nil {
+		return errors.Join(err, errors.New("failed to get worktree"))
+	}
+
+	err = wt.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(hash), Force: true})
+	if err != nil {
+		return errors.Join(err, fmt.Errorf("failed to checkout commit %s", hash))
+	}
+
+	return nil
+}
@@ -0,0 +1,381 @@
+package pdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// historyCommitPattern matches full and abbreviated commit hashes, nothing
+// else is resolved as a historical commit.
+var historyCommitPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+// resolveHistorical resolves a past revision from the history repository,
+// leaving the active revision alone. With a commit, abbreviated or not, that
+// commit is resolved. Otherwise the revision the project followed at the time
+// is, see followedAt. The remote is only fetched from when the commit isn't
+// known yet, or the followed refs weren't fetched up to the time.
+func (s *gitSource) resolveHistorical(ctx context.Context, commit string, at time.Time) (*PolicyRevision, error) {
+	s.repoMtx.Lock()
+	defer s.repoMtx.Unlock()
+
+	repo, err := s.historyRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	ref := &resolvedRef{}
+	if commit != "" {
+		if !historyCommitPattern.MatchString(commit) {
+			return nil, fmt.Errorf("invalid commit: %s", commit)
+		}
+
+		hash, err := resolveCommit(repo, commit)
+		if err != nil {
+			err = s.fetchHistory(ctx, repo, s.historyRefSpecs()...)
+			if err != nil {
+				return nil, err
+			}
+
+			hash, err = resolveCommit(repo, commit)
+			if err != nil {
+				return nil, fmt.Errorf("commit %s not found", commit)
+			}
+		}
+		ref.Hash = hash.String()
+	} else {
+		ref, err = s.followedAt(ctx, repo, at)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	revision := ref.revision()
+	revision.Commit = commitInfo(repo, ref.Hash)
+	return revision, nil
+}
+
+// loadHistorical loads the policies of a resolved past revision, reading them
+// from the history repository without touching the worktree of the cache.
+func (s *gitSource) loadHistorical(ctx context.Context, revision *PolicyRevision) ([]PolicyBundle, error) {
+	s.repoMtx.Lock()
+	defer s.repoMtx.Unlock()
+
+	repo, err := s.historyRepository()
+	if err != nil {
+		return nil, err
+	}
+
+	ref := resolvedRevision(revision)
+	if s.project.Trust.enabled() {
+		if _, err := s.project.Trust.verify(repo, ref); err != nil {
+			return nil, err
+		}
+	}
+
+	fs, err := commitFilesystem(repo, ref.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return discoverBundles(fs, s.project.Root, s.project.Include, s.project.Exclude)
+}
+
+// followedAt resolves the revision the project followed at the time: the
+// pinned commit, the newest matching tag whose commit is at or before the
+// time, or the last commit on the branch at or before the time.
+func (s *gitSource) followedAt(ctx context.Context, repo *git.Repository, at time.Time) (*resolvedRef, error) {
+	switch {
+	case s.project.Commit != "":
+		ref, err := s.project.pinnedCommit()
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := repo.CommitObject(plumbing.NewHash(ref.Hash)); err != nil {
+			if err := s.fetchHistory(ctx, repo, s.historyRefSpecs()...); err != nil {
+				return nil, err
+			}
+		}
+
+		if _, err := repo.CommitObject(plumbing.NewHash(ref.Hash)); err != nil {
+			return nil, fmt.Errorf("commit %s not found", ref.Hash)
+		}
+
+		return ref, nil
+	case s.project.Version != "" || s.project.Tag != "":
+		return s.tagAt(ctx, repo, at)
+	case s.project.Branch != "":
+		name := plumbing.NewRemoteReferenceName(cacheRemoteName, s.project.Branch)
+		if !branchCovers(repo, name, at) {
+			refSpec := config.RefSpec(fmt.Sprintf("+%s:%s", plumbing.NewBranchReferenceName(s.project.Branch), name))
+			if err := s.fetchHistory(ctx, repo, refSpec); err != nil {
+				return nil, err
+			}
+		}
+
+		hash, err := commitAt(repo, name, at)
+		if err != nil {
+			return nil, err
+		}
+
+		return &resolvedRef{Hash: hash.String()}, nil
+	}
+
+	return nil, errors.New("no branch, tag, version or commit to resolve history on")
+}
+
+// tagAt resolves the newest tag matching the tag pattern or version
+// constraint whose commit is at or before the time. Tags are only fetched if
+// no matching tag has a commit after the time yet.
+func (s *gitSource) tagAt(ctx context.Context, repo *git.Repository, at time.Time) (*resolvedRef, error) {
+	match, err := s.project.tagMatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	tags, covered, err := matchingTags(repo, match, at)
+	if err != nil {
+		return nil, err
+	}
+
+	if !covered {
+		if err := s.fetchHistory(ctx, repo, "+refs/tags/*:refs/tags/*"); err != nil {
+			return nil, err
+		}
+
+		tags, _, err = matchingTags(repo, match, at)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var best *resolvedRef
+	for _, tag := range tags {
+		if best == nil || newerTag(tag.Name.Short(), best.Name.Short()) {
+			best = tag
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no tag matching %s at or before %s", s.project.targetDescription(), at.UTC().Format(time.RFC3339))
+	}
+
+	return best, nil
+}
+
+// historyRefSpecs returns what is fetched to find a commit that isn't known
+// yet: the branches, and the tags when following tags.
+func (s *gitSource) historyRefSpecs() []config.RefSpec {
+	refSpecs := []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"}
+	if s.project.Commit == "" && (s.project.Version != "" || s.project.Tag != "") {
+		refSpecs = append(refSpecs, "+refs/tags/*:refs/tags/*")
+	}
+
+	return refSpecs
+}
+
+// historyRepository opens the repository history is read from: the on-disk
+// cache if configured, or else a repository in memory kept for the lifetime
+// of the source. Either way objects are fetched into it as needed, so only
+// the first historical decision downloads the history. The repository mutex
+// must be held.
+func (s *gitSource) historyRepository() (*git.Repository, error) {
+	if s.project.CacheDir != "" {
+		return s.openCache()
+	}
+
+	if s.history != nil {
+		return s.history, nil
+	}
+
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = repo.CreateRemote(&config.RemoteConfig{
+		Name: cacheRemoteName,
+		URLs: []string{s.project.Url},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.history = repo
+	return repo, nil
+}
+
+func (s *gitSource) fetchHistory(ctx context.Context, repo *git.Repository, refSpecs ...config.RefSpec) error {
+	auth, err := s.project.Auth.transportAuth(s.project.Url)
+	if err != nil {
+		return err
+	}
+
+	err = repo.FetchContext(ctx, &git.FetchOptions{
+		RemoteName: cacheRemoteName,
+		RefSpecs:   refSpecs,
+		Auth:       auth,
+		Tags:       git.NoTags,
+		Force:      true,
+	})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return errors.Join(err, errors.New("failed to fetch"))
+	}
+
+	return nil
+}
+
+func resolveCommit(repo *git.Repository, commit string) (plumbing.Hash, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(commit))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if _, err := repo.CommitObject(*hash); err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	return *hash, nil
+}
+
+// branchCovers reports whether the fetched branch has a commit after the
+// time, so the commit at the time is known without fetching.
+func branchCovers(repo *git.Repository, name plumbing.ReferenceName, at time.Time) bool {
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		return false
+	}
+
+	commit, err := repo.CommitObject(ref.Hash())
+	return err == nil && commit.Committer.When.After(at)
+}
+
+// matchingTags returns the local tags accepted by match whose commit is at or
+// before the time, and whether any matching tag has a commit after the time,
+// so newer tags are known without fetching.
+func matchingTags(repo *git.Repository, match func(string) bool, at time.Time) ([]*resolvedRef, bool, error) {
+	refs, err := repo.Tags()
+	if err != nil {
+		return nil, false, err
+	}
+	defer refs.Close()
+
+	var tags []*resolvedRef
+	covered := false
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if !match(ref.Name().Short()) {
+			return nil
+		}
+
+		// annotated tags point at a tag object
+		hash := ref.Hash()
+		if tag, err := repo.TagObject(hash); err == nil {
+			hash = tag.Target
+		}
+
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil
+		}
+
+		if commit.Committer.When.After(at) {
+			covered = true
+			return nil
+		}
+
+		tags = append(tags, &resolvedRef{Name: ref.Name(), Hash: hash.String()})
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return tags, covered, nil
+}
+
+// commitAt returns the newest commit reachable from the ref that was
+// committed at or before the time.
+func commitAt(repo *git.Repository, name plumbing.ReferenceName, at time.Time) (plumbing.Hash, error) {
+	ref, err := repo.Reference(name, true)
+	if err != nil {
+		return plumbing.ZeroHash, errors.Join(err, fmt.Errorf("failed to get %s", name))
+	}
+
+	commits, err := repo.Log(&git.LogOptions{From: ref.Hash(), Order: git.LogOrderCommitterTime})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer commits.Close()
+
+	var hash plumbing.Hash
+	err = commits.ForEach(func(c *object.Commit) error {
+		if c.Committer.When.After(at) {
+			return nil
+		}
+
+		hash = c.Hash
+		return storer.ErrStop
+	})
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if hash.IsZero() {
+		return plumbing.ZeroHash, fmt.Errorf("no commit at or before %s", at.UTC().Format(time.RFC3339))
+	}
+
+	return hash, nil
+}
+
+// commitFilesystem copies the files of the commit into memory.
+func commitFilesystem(repo *git.Repository, hash string) (billy.Filesystem, error) {
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to get commit %s", hash))
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	fs := memfs.New()
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if !f.Mode.IsFile() {
+			return nil
+		}
+
+		reader, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		file, err := fs.Create(f.Name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = io.Copy(file, reader)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to read commit %s", hash))
+	}
+
+	return fs, nil
+}
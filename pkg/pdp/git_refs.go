@@ -0,0 +1,165 @@
+package pdp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/gobwas/glob"
+)
+
+const peeledSuffix = "^{}"
+
+var commitHashPattern = regexp.MustCompile("^[0-9a-f]{40}$")
+
+// resolvedRef is the revision of a project to load policies from.
+type resolvedRef struct {
+	Name plumbing.ReferenceName // the branch or tag, empty for a pinned commit
+	Hash string                 // the commit hash
+}
+
+func (r *resolvedRef) String() string {
+	if r.Name == "" {
+		return r.Hash
+	}
+
+	return r.Name.String()
+}
+
+func (r *resolvedRef) revision() *PolicyRevision {
+	return &PolicyRevision{Ref: r.String(), Hash: r.Hash}
+}
+
+// resolvedRevision is the inverse of resolvedRef.revision, a revision whose
+// ref is its hash is a pinned commit.
+func resolvedRevision(revision *PolicyRevision) *resolvedRef {
+	if revision.Ref == revision.Hash {
+		return &resolvedRef{Hash: revision.Hash}
+	}
+
+	return &resolvedRef{Name: plumbing.ReferenceName(revision.Ref), Hash: revision.Hash}
+}
+
+// targetDescription describes what the project follows, for error messages.
+func (p *PolicyProject) targetDescription() string {
+	switch {
+	case p.Commit != "":
+		return "commit " + p.Commit
+	case p.Version != "":
+		return "version " + p.Version
+	case p.Tag != "":
+		return "tag " + p.Tag
+	}
+
+	return "branch " + p.Branch
+}
+
+// resolveRef picks the revision to load from the refs advertised by the
+// remote. A pinned commit takes precedence over a version constraint, which
+// takes precedence over a tag pattern, which takes precedence over the branch.
+func (p *PolicyProject) resolveRef(refs []*plumbing.Reference) (*resolvedRef, error) {
+	if p.Commit != "" {
+		return p.pinnedCommit()
+	}
+
+	if p.Version != "" || p.Tag != "" {
+		return p.resolveTag(refs)
+	}
+
+	name := plumbing.NewBranchReferenceName(p.Branch)
+	for _, ref := range refs {
+		if ref.Name() == name && !ref.Hash().IsZero() {
+			return &resolvedRef{Name: name, Hash: ref.Hash().String()}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("branch %s not found", p.Branch)
+}
+
+func (p *PolicyProject) pinnedCommit() (*resolvedRef, error) {
+	hash := strings.ToLower(p.Commit)
+	if !commitHashPattern.MatchString(hash) {
+		return nil, fmt.Errorf("pinned commit must be a full sha-1 hash: %s", p.Commit)
+	}
+
+	return &resolvedRef{Hash: hash}, nil
+}
+
+// resolveTag finds the newest tag matching the version constraint or tag
+// pattern. Tags are ordered by semantic version where they can be parsed, and
+// by name otherwise.
+func (p *PolicyProject) resolveTag(refs []*plumbing.Reference) (*resolvedRef, error) {
+	match, err := p.tagMatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// annotated tags point at a tag object, the commit is advertised as a
+	// separate peeled ref
+	peeled := map[plumbing.ReferenceName]plumbing.Hash{}
+	for _, ref := range refs {
+		if name := ref.Name().String(); strings.HasSuffix(name, peeledSuffix) {
+			peeled[plumbing.ReferenceName(strings.TrimSuffix(name, peeledSuffix))] = ref.Hash()
+		}
+	}
+
+	var best *plumbing.Reference
+	for _, ref := range refs {
+		if !ref.Name().IsTag() || strings.HasSuffix(ref.Name().String(), peeledSuffix) {
+			continue
+		}
+
+		if !match(ref.Name().Short()) {
+			continue
+		}
+
+		if best == nil || newerTag(ref.Name().Short(), best.Name().Short()) {
+			best = ref
+		}
+	}
+
+	if best == nil {
+		return nil, fmt.Errorf("no tag matches %s", p.targetDescription())
+	}
+
+	hash := best.Hash()
+	if commit, ok := peeled[best.Name()]; ok {
+		hash = commit
+	}
+
+	return &resolvedRef{Name: best.Name(), Hash: hash.String()}, nil
+}
+
+func (p *PolicyProject) tagMatcher() (func(string) bool, error) {
+	if p.Version != "" {
+		constraint, err := semver.NewConstraint(p.Version)
+		if err != nil {
+			return nil, errors.Join(err, errors.New("invalid version constraint"))
+		}
+
+		return func(tag string) bool {
+			version, err := semver.NewVersion(tag)
+			return err == nil && constraint.Check(version)
+		}, nil
+	}
+
+	pattern, err := glob.Compile(p.Tag)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("invalid tag pattern"))
+	}
+
+	return pattern.Match, nil
+}
+
+func newerTag(a string, b string) bool {
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	if errA == nil && errB == nil {
+		return va.GreaterThan(vb)
+	}
+
+	return a > b
+}
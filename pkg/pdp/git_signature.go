@@ -0,0 +1,258 @@
+package pdp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	sshSigMagic     = "SSHSIG"
+	sshSigNamespace = "git"
+)
+
+// ErrUntrustedRevision is returned when a revision isn't signed by one of the
+// trusted keys.
+var ErrUntrustedRevision = errors.New("revision is not signed by a trusted key")
+
+// PolicyTrust holds the keys a revision must be signed by before its policies
+// are activated. If no keys are configured signatures aren't checked.
+type PolicyTrust struct {
+	OpenPGPKeys []string // armored OpenPGP public keys
+	SSHKeys     []string // ssh public keys, in authorized_keys format
+}
+
+func (t *PolicyTrust) enabled() bool {
+	return len(t.OpenPGPKeys) > 0 || len(t.SSHKeys) > 0
+}
+
+// verify checks the signature of the resolved revision. An annotated tag may
+// be signed itself, otherwise the commit must be signed. It returns a
+// description of the key that signed the revision.
+func (t *PolicyTrust) verify(repo *git.Repository, ref *resolvedRef) (string, error) {
+	var errs []error
+	if ref.Name.IsTag() {
+		tag, err := annotatedTag(repo, ref.Name)
+		if err != nil {
+			return "", err
+		}
+
+		if tag != nil {
+			signer, err := t.verifyObject(tag.PGPSignature, tag.EncodeWithoutSignature)
+			if err == nil {
+				return signer, nil
+			}
+
+			errs = append(errs, fmt.Errorf("tag %s: %w", ref.Name.Short(), err))
+		}
+	}
+
+	commit, err := repo.CommitObject(plumbing.NewHash(ref.Hash))
+	if err != nil {
+		return "", errors.Join(err, errors.New("failed to get commit"))
+	}
+
+	signer, err := t.verifyObject(commit.PGPSignature, commit.EncodeWithoutSignature)
+	if err == nil {
+		return signer, nil
+	}
+
+	errs = append(errs, fmt.Errorf("commit %s: %w", ref.Hash, err))
+	return "", errors.Join(ErrUntrustedRevision, errors.Join(errs...))
+}
+
+// verifyObject verifies the signature of a commit or tag, which go-git keeps in
+// the PGPSignature field for ssh signatures as well.
+func (t *PolicyTrust) verifyObject(signature string, encode func(plumbing.EncodedObject) error) (string, error) {
+	if signature == "" {
+		return "", errors.New("not signed")
+	}
+
+	encoded := &plumbing.MemoryObject{}
+	if err := encode(encoded); err != nil {
+		return "", err
+	}
+
+	reader, err := encoded.Reader()
+	if err != nil {
+		return "", err
+	}
+
+	message, err := io.ReadAll(reader)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(signature, "-----BEGIN SSH SIGNATURE-----") {
+		return t.verifySSH([]byte(signature), message)
+	}
+
+	return t.verifyOpenPGP(signature, message)
+}
+
+func (t *PolicyTrust) verifyOpenPGP(signature string, message []byte) (string, error) {
+	if len(t.OpenPGPKeys) == 0 {
+		return "", errors.New("signed with OpenPGP, but no OpenPGP keys are trusted")
+	}
+
+	var keyRing openpgp.EntityList
+	for _, keys := range t.OpenPGPKeys {
+		// ReadArmoredKeyRing only reads the first armored block, so split
+		// files holding several exported keys
+		for _, key := range splitArmoredKeys(keys) {
+			entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+			if err != nil {
+				return "", errors.Join(err, errors.New("invalid trusted OpenPGP key"))
+			}
+
+			keyRing = append(keyRing, entities...)
+		}
+	}
+
+	entity, err := openpgp.CheckArmoredDetachedSignature(keyRing, bytes.NewReader(message), strings.NewReader(signature), nil)
+	if err != nil {
+		return "", err
+	}
+
+	for _, identity := range entity.Identities {
+		return fmt.Sprintf("openpgp:%s (%X)", identity.Name, entity.PrimaryKey.Fingerprint), nil
+	}
+
+	return fmt.Sprintf("openpgp:%X", entity.PrimaryKey.Fingerprint), nil
+}
+
+func (t *PolicyTrust) verifySSH(armored []byte, message []byte) (string, error) {
+	if len(t.SSHKeys) == 0 {
+		return "", errors.New("signed with ssh, but no ssh keys are trusted")
+	}
+
+	signer, err := verifySSHSignature(armored, message)
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range t.SSHKeys {
+		trusted, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key))
+		if err != nil {
+			return "", errors.Join(err, errors.New("invalid trusted ssh key"))
+		}
+
+		if bytes.Equal(trusted.Marshal(), signer.Marshal()) {
+			return "ssh:" + gossh.FingerprintSHA256(signer), nil
+		}
+	}
+
+	return "", fmt.Errorf("signed by untrusted ssh key %s", gossh.FingerprintSHA256(signer))
+}
+
+// verifySSHSignature verifies an armored ssh signature (as created by
+// ssh-keygen -Y sign) over the message, and returns the key that signed it.
+// See https://github.com/openssh/openssh-portable/blob/master/PROTOCOL.sshsig
+func verifySSHSignature(armored []byte, message []byte) (gossh.PublicKey, error) {
+	block, _ := pem.Decode(armored)
+	if block == nil || block.Type != "SSH SIGNATURE" {
+		return nil, errors.New("invalid ssh signature armor")
+	}
+
+	blob := block.Bytes
+	if !bytes.HasPrefix(blob, []byte(sshSigMagic)) {
+		return nil, errors.New("invalid ssh signature magic")
+	}
+
+	var sig struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}
+	if err := gossh.Unmarshal(blob[len(sshSigMagic):], &sig); err != nil {
+		return nil, errors.Join(err, errors.New("invalid ssh signature"))
+	}
+
+	if sig.Version != 1 {
+		return nil, fmt.Errorf("unsupported ssh signature version: %d", sig.Version)
+	}
+
+	if sig.Namespace != sshSigNamespace {
+		return nil, fmt.Errorf("unexpected ssh signature namespace: %s", sig.Namespace)
+	}
+
+	var h hash.Hash
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, fmt.Errorf("unsupported ssh signature hash: %s", sig.HashAlgorithm)
+	}
+	h.Write(message)
+
+	publicKey, err := gossh.ParsePublicKey(sig.PublicKey)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("invalid ssh signature key"))
+	}
+
+	var signature gossh.Signature
+	if err := gossh.Unmarshal(sig.Signature, &signature); err != nil {
+		return nil, errors.Join(err, errors.New("invalid ssh signature"))
+	}
+
+	signed := append([]byte(sshSigMagic), gossh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sig.Namespace, sig.Reserved, sig.HashAlgorithm, h.Sum(nil)})...)
+
+	if err := publicKey.Verify(signed, &signature); err != nil {
+		return nil, errors.Join(err, errors.New("ssh signature verification failed"))
+	}
+
+	return publicKey, nil
+}
+
+func splitArmoredKeys(keys string) []string {
+	const begin = "-----BEGIN PGP PUBLIC KEY BLOCK-----"
+
+	var blocks []string
+	for _, block := range strings.Split(keys, begin) {
+		if strings.TrimSpace(block) != "" {
+			blocks = append(blocks, begin+block)
+		}
+	}
+
+	return blocks
+}
+
+// annotatedTag returns the tag object of an annotated tag, or nil for a
+// lightweight tag.
+func annotatedTag(repo *git.Repository, name plumbing.ReferenceName) (*object.Tag, error) {
+	ref, err := repo.Reference(name, false)
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to get %s", name))
+	}
+
+	tag, err := repo.TagObject(ref.Hash())
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return tag, nil
+}
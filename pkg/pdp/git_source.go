@@ -0,0 +1,251 @@
+package pdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"log/slog"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// gitSource provides the policies of a project in a git repository.
+type gitSource struct {
+	project   PolicyProject
+	mtx       sync.Mutex
+	signature SignatureStatus
+
+	repoMtx sync.Mutex      // serializes use of the on-disk cache, and the history repository
+	history *git.Repository // the history repository, when there is no on-disk cache
+}
+
+// NewGitSource creates a source for the policies of the project.
+func NewGitSource(project PolicyProject) PolicySource {
+	return &gitSource{project: project}
+}
+
+// Name returns the name of the project, or its url if it has none.
+func (s *gitSource) Name() string {
+	if s.project.Name != "" {
+		return s.project.Name
+	}
+
+	return s.project.Url
+}
+
+// Revision resolves the revision the project follows, listing the remote refs
+// unless a commit is pinned.
+func (s *gitSource) Revision(ctx context.Context) (*PolicyRevision, error) {
+	ref, err := s.resolveRemoteRef()
+	if err != nil {
+		return nil, err
+	}
+
+	return ref.revision(), nil
+}
+
+// Load clones or fetches the revision, and loads its policies.
+func (s *gitSource) Load(ctx context.Context, revision *PolicyRevision) ([]PolicyBundle, error) {
+	s.repoMtx.Lock()
+	defer s.repoMtx.Unlock()
+
+	ref := resolvedRevision(revision)
+	repo, err := s.getGitRepo(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	bundles, err := s.loadBundles(repo, ref)
+	if err != nil {
+		return nil, err
+	}
+
+	revision.Hash = ref.Hash
+	revision.Commit = commitInfo(repo, ref.Hash)
+	return bundles, nil
+}
+
+// commitInfo returns the author and message of the commit, or nil if it
+// can't be read.
+func commitInfo(repo *git.Repository, hash string) *PolicyCommit {
+	commit, err := repo.CommitObject(plumbing.NewHash(hash))
+	if err != nil {
+		return nil
+	}
+
+	return &PolicyCommit{
+		Author:  commit.Author.Name,
+		Email:   commit.Author.Email,
+		Message: strings.TrimSpace(commit.Message),
+		Time:    commit.Author.When.UTC(),
+	}
+}
+
+// matchesRef reports whether the ref (e.g. refs/heads/main) can change the
+// revision the project follows. Any tag can when following tags, nothing can
+// when a commit is pinned.
+func (s *gitSource) matchesRef(ref string) bool {
+	name := plumbing.ReferenceName(ref)
+	switch {
+	case s.project.Commit != "":
+		return false
+	case s.project.Version != "" || s.project.Tag != "":
+		return name.IsTag()
+	}
+
+	return name == plumbing.NewBranchReferenceName(s.project.Branch)
+}
+
+// loadBundles verifies the checked out revision if required, and loads its
+// policies.
+func (s *gitSource) loadBundles(repo *git.Repository, ref *resolvedRef) ([]PolicyBundle, error) {
+	if s.project.Trust.enabled() {
+		err := s.verifySignature(repo, ref)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get worktree"))
+	}
+
+	return discoverBundles(wt.Filesystem, s.project.Root, s.project.Include, s.project.Exclude)
+}
+
+// verifySignature refuses revisions not signed by a trusted key, and records
+// the outcome in the signature status.
+func (s *gitSource) verifySignature(repo *git.Repository, ref *resolvedRef) error {
+	signer, err := s.project.Trust.verify(repo, ref)
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.signature.Required = true
+	if err != nil {
+		s.signature.Refusals++
+		s.signature.LastRefusal = err.Error()
+		s.signature.LastRefusedHash = ref.Hash
+		s.signature.LastRefusalTime = time.Now().UTC()
+		slog.Error("refused policy revision", slog.String("repo", s.project.Url), slog.String("ref", ref.String()), slog.String("hash", ref.Hash), slog.String("error", err.Error()))
+		return err
+	}
+
+	s.signature.Verifications++
+	s.signature.Signer = signer
+	s.signature.VerifiedHash = ref.Hash
+	slog.Info("verified policy revision", slog.String("repo", s.project.Url), slog.String("ref", ref.String()), slog.String("signer", signer))
+	return nil
+}
+
+// SignatureStatus reports the outcome of the signature verification of the
+// revisions loaded so far.
+func (s *gitSource) SignatureStatus() SignatureStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	status := s.signature
+	status.Required = s.project.Trust.enabled()
+	return status
+}
+
+// resolveRemoteRef resolves the revision the project follows, listing the
+// remote refs unless a commit is pinned.
+func (s *gitSource) resolveRemoteRef() (*resolvedRef, error) {
+	if s.project.Commit != "" {
+		return s.project.pinnedCommit()
+	}
+
+	auth, err := s.project.Auth.transportAuth(s.project.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+		Name: s.project.Url,
+		URLs: []string{s.project.Url},
+	})
+
+	list, err := remote.List(&git.ListOptions{
+		Auth: auth,
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to list remote"))
+	}
+
+	return s.project.resolveRef(list)
+}
+
+// getGitRepo clones the repository at the resolved revision, or updates the
+// on-disk cache if configured. Branches and tags are shallow cloned, a pinned
+// commit needs the full history as servers don't have to allow fetching
+// arbitrary commits.
+func (s *gitSource) getGitRepo(ref *resolvedRef) (*git.Repository, error) {
+	auth, err := s.project.Auth.transportAuth(s.project.Url)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.project.CacheDir != "" {
+		return s.fetchCached(ref, auth)
+	}
+
+	if ref.Name == "" {
+		return s.cloneCommit(ref.Hash, auth)
+	}
+
+	repo, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{
+		URL:           s.project.Url,
+		ReferenceName: ref.Name,
+		Auth:          auth,
+		SingleBranch:  true,
+		Depth:         1,
+		Tags:          git.NoTags,
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to clone"))
+	}
+
+	// the ref might have moved since it was resolved, make sure we report
+	// what we actually loaded
+	head, err := repo.Head()
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get head"))
+	}
+
+	ref.Hash = head.Hash().String()
+	return repo, nil
+}
+
+func (s *gitSource) cloneCommit(hash string, auth transport.AuthMethod) (*git.Repository, error) {
+	repo, err := git.Clone(memory.NewStorage(), memfs.New(), &git.CloneOptions{
+		URL:        s.project.Url,
+		Auth:       auth,
+		NoCheckout: true,
+	})
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to clone"))
+	}
+
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to get worktree"))
+	}
+
+	err = wt.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(hash)})
+	if err != nil {
+		return nil, errors.Join(err, fmt.Errorf("failed to checkout commit %s", hash))
+	}
+
+	return repo, nil
+}
@@ -2,6 +2,8 @@ package pdp
 
 import (
 	"container/list"
+
+	"github.com/google/uuid"
 )
 
 // logBuffer implements a circular FIFO buffer for the plugin that caps memory
@@ -13,8 +15,16 @@ type logBuffer struct {
 	l     *list.List
 }
 
-type logBufferElem struct {
-	bs []byte
+// logChunk is a compressed batch of decision events. The ID stays the same
+// across retries, so collectors can use it to deduplicate uploads.
+type logChunk struct {
+	id       string
+	bs       []byte
+	attempts int // number of failed uploads
+}
+
+func newLogChunk(bs []byte) *logChunk {
+	return &logChunk{id: uuid.NewString(), bs: bs}
 }
 
 func newLogBuffer(limit int64) *logBuffer {
@@ -25,32 +35,30 @@ func newLogBuffer(limit int64) *logBuffer {
 	}
 }
 
-func (lb *logBuffer) Push(bs []byte) (dropped int) {
-	size := int64(len(bs))
+func (lb *logBuffer) Push(chunk *logChunk) (dropped int) {
+	size := int64(len(chunk.bs))
 
 	if lb.limit > 0 {
-		for elem := lb.l.Front(); elem != nil && (lb.usage+size > lb.limit); elem = elem.Next() {
-			drop := elem.Value.(logBufferElem).bs
+		for elem := lb.l.Front(); elem != nil && (lb.usage+size > lb.limit); elem = lb.l.Front() {
+			drop := elem.Value.(*logChunk).bs
 			lb.l.Remove(elem)
 			lb.usage -= int64(len(drop))
 			dropped++
 		}
 	}
 
-	elem := logBufferElem{bs}
-
-	lb.l.PushBack(elem)
+	lb.l.PushBack(chunk)
 	lb.usage += size
 	return dropped
 }
 
-func (lb *logBuffer) Pop() []byte {
+func (lb *logBuffer) Pop() *logChunk {
 	elem := lb.l.Front()
 	if elem != nil {
-		e := elem.Value.(logBufferElem)
-		lb.usage -= int64(len(e.bs))
+		chunk := elem.Value.(*logChunk)
+		lb.usage -= int64(len(chunk.bs))
 		lb.l.Remove(elem)
-		return e.bs
+		return chunk
 	}
 	return nil
 }
@@ -58,3 +66,7 @@ func (lb *logBuffer) Pop() []byte {
 func (lb *logBuffer) Len() int {
 	return lb.l.Len()
 }
+
+func (lb *logBuffer) Size() int64 {
+	return lb.usage
+}
@@ -0,0 +1,160 @@
+package pdp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	deadLetterDataExt = ".json.gz"
+	deadLetterMetaExt = ".meta.json"
+)
+
+// uploadStatusError is returned when the collector responds with a non 2xx
+// status code.
+type uploadStatusError struct {
+	StatusCode int
+}
+
+func (e *uploadStatusError) Error() string {
+	return fmt.Sprintf("log upload invalid status code: %d", e.StatusCode)
+}
+
+// isPermanentUploadError reports whether retrying the upload can't succeed.
+// Client errors are permanent, except timeouts and rate limiting.
+func isPermanentUploadError(err error) bool {
+	var e *uploadStatusError
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.StatusCode {
+	case 408, 425, 429:
+		return false
+	}
+
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// uploadStatusCode returns the collector status code of an upload error, or 0.
+func uploadStatusCode(err error) int {
+	var e *uploadStatusError
+	if errors.As(err, &e) {
+		return e.StatusCode
+	}
+
+	return 0
+}
+
+// deadLetterStore keeps chunks that failed permanently on disk. Each chunk is
+// stored as two files named after the chunk id, the compressed chunk itself
+// and a json file describing the failure.
+type deadLetterStore struct {
+	dir         string
+	destination string
+}
+
+func newDeadLetterStore(dir string, destination string) *deadLetterStore {
+	return &deadLetterStore{dir: dir, destination: destination}
+}
+
+func (s *deadLetterStore) Put(chunk *logChunk, cause error) error {
+	if err := os.MkdirAll(s.dir, 0o750); err != nil {
+		return err
+	}
+
+	entry := DeadLetterEntry{
+		Destination: s.destination,
+		ChunkID:     chunk.id,
+		StatusCode:  uploadStatusCode(cause),
+		Error:       cause.Error(),
+		Attempts:    chunk.attempts,
+		Timestamp:   time.Now().UTC(),
+		Size:        int64(len(chunk.bs)),
+	}
+
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// write the data first, so a listed entry always has its data
+	if err := os.WriteFile(s.path(chunk.id, deadLetterDataExt), chunk.bs, 0o640); err != nil {
+		return err
+	}
+
+	return os.WriteFile(s.path(chunk.id, deadLetterMetaExt), meta, 0o640)
+}
+
+func (s *deadLetterStore) Get(id string) (*logChunk, *DeadLetterEntry, error) {
+	meta, err := os.ReadFile(s.path(id, deadLetterMetaExt))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var entry DeadLetterEntry
+	if err := json.Unmarshal(meta, &entry); err != nil {
+		return nil, nil, err
+	}
+
+	bs, err := os.ReadFile(s.path(id, deadLetterDataExt))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &logChunk{id: id, bs: bs, attempts: entry.Attempts}, &entry, nil
+}
+
+// List returns the stored entries, oldest first.
+func (s *deadLetterStore) List() ([]DeadLetterEntry, error) {
+	files, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var entries []DeadLetterEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), deadLetterMetaExt) {
+			continue
+		}
+
+		_, entry, err := s.Get(strings.TrimSuffix(f.Name(), deadLetterMetaExt))
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, *entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Timestamp.Before(entries[j].Timestamp)
+	})
+
+	return entries, nil
+}
+
+func (s *deadLetterStore) Delete(id string) error {
+	err := os.Remove(s.path(id, deadLetterMetaExt))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = os.Remove(s.path(id, deadLetterDataExt))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (s *deadLetterStore) path(id string, ext string) string {
+	return filepath.Join(s.dir, filepath.Base(id)+ext)
+}
@@ -0,0 +1,681 @@
+package pdp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"log/slog"
+
+	"github.com/patrickfnielsen/pdp-client/internal/util"
+)
+
+const (
+	minRetryDelay               = time.Millisecond * 100
+	defaultMinDelaySeconds      = int64(1)
+	defaultMaxDelaySeconds      = int64(10)
+	defaultBufferChunkSizeBytes = int64(32768) // 32KB limit
+	defaultBufferSizeLimitBytes = int64(0)     // unlimited
+	defaultUploadConcurrency    = 4
+	maxAckSizeBytes             = int64(1 << 20)
+
+	// ChunkIDHeader carries the stable ID of an uploaded chunk.
+	ChunkIDHeader = "Idempotency-Key"
+
+	LogFormatJSON   = "json"
+	LogFormatNDJSON = "ndjson"
+)
+
+// DecisionLogDestination configures a HTTP endpoint decision logs are uploaded
+// to. Every destination has its own buffer, encoder and retry state, so a slow
+// destination doesn't hold back the others.
+type DecisionLogDestination struct {
+	Name                 string                    // unique name of the destination, defaults to the endpoint
+	Format               string                    // "json" for a json array (default), or "ndjson" for newline delimited json
+	Filter               func(DecisionResult) bool // only decisions the filter returns true for are uploaded, nil uploads all
+	BufferChunkSizeBytes *int64
+	BufferSizeLimitBytes *int64
+	MinDelaySeconds      *int64
+	MaxDelaySeconds      *int64
+	Endpoint             string
+	EndpointTimeout      int
+	BearerToken          string
+	MaxBacklogBytes      int64  // readiness fails when more than this is buffered, 0 disables the check
+	UploadTriggerBytes   int64  // upload early when more than this is buffered, 0 disables the trigger
+	UploadTriggerEvents  int64  // upload early when more than this many events are buffered, 0 disables the trigger
+	UploadConcurrency    *int   // maximum number of chunks uploaded in parallel
+	MaxUploadAttempts    int    // give up on a chunk after this many failed uploads, 0 retries forever
+	DeadLetterDir        string // directory for chunks that were given up on, if empty they are dropped
+}
+
+func (c *DecisionLogDestination) validateAndInjectDefaults() error {
+	min := defaultMinDelaySeconds
+	max := defaultMaxDelaySeconds
+
+	if c.Name == "" {
+		c.Name = c.Endpoint
+	}
+
+	switch c.Format {
+	case "":
+		c.Format = LogFormatJSON
+	case LogFormatJSON, LogFormatNDJSON:
+	default:
+		return fmt.Errorf("unknown format %q for decision log destination %s", c.Format, c.Name)
+	}
+
+	// reject bad min/max values
+	if c.MaxDelaySeconds != nil && c.MinDelaySeconds != nil {
+		if *c.MaxDelaySeconds < *c.MinDelaySeconds {
+			return fmt.Errorf("max reporting delay must be >= min reporting delay in decision_logs")
+		}
+		min = *c.MinDelaySeconds
+		max = *c.MaxDelaySeconds
+	} else if c.MaxDelaySeconds == nil && c.MinDelaySeconds != nil {
+		return fmt.Errorf("reporting configuration missing 'max_delay_seconds' in decision_logs")
+	} else if c.MinDelaySeconds == nil && c.MaxDelaySeconds != nil {
+		return fmt.Errorf("reporting configuration missing 'min_delay_seconds' in decision_logs")
+	}
+
+	// scale to seconds
+	minSeconds := int64(time.Duration(min) * time.Second)
+	c.MinDelaySeconds = &minSeconds
+
+	maxSeconds := int64(time.Duration(max) * time.Second)
+	c.MaxDelaySeconds = &maxSeconds
+
+	// default the upload size limit
+	uploadLimit := defaultBufferChunkSizeBytes
+	if c.BufferChunkSizeBytes != nil {
+		uploadLimit = *c.BufferChunkSizeBytes
+	}
+
+	c.BufferChunkSizeBytes = &uploadLimit
+
+	// default the buffer size limit
+	bufferLimit := defaultBufferSizeLimitBytes
+	if c.BufferSizeLimitBytes != nil {
+		bufferLimit = *c.BufferSizeLimitBytes
+	}
+
+	c.BufferSizeLimitBytes = &bufferLimit
+
+	// default the upload concurrency
+	concurrency := defaultUploadConcurrency
+	if c.UploadConcurrency != nil {
+		if *c.UploadConcurrency < 1 {
+			return fmt.Errorf("upload concurrency must be >= 1 in decision_logs")
+		}
+		concurrency = *c.UploadConcurrency
+	}
+
+	c.UploadConcurrency = &concurrency
+
+	return nil
+}
+
+type logDestination struct {
+	config     *DecisionLogDestination
+	buffer     *logBuffer
+	enc        *chunkEncoder
+	httpClient *http.Client
+	mtx        sync.Mutex
+	uploadMtx  sync.Mutex // serializes uploads, so a flush waits for the upload in progress
+	stop       chan chan struct{}
+	trigger    chan struct{}
+	events     int64 // events buffered since the last upload, guarded by mtx
+
+	dropped      atomic.Int64
+	deadLettered atomic.Int64
+	deadLetters  *deadLetterStore
+
+	// upload state, guarded by mtx
+	lastUpload          time.Time
+	consecutiveFailures int
+	currentBackoff      time.Duration
+}
+
+func newLogDestination(config *DecisionLogDestination) (*logDestination, error) {
+	err := config.validateAndInjectDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	return &logDestination{
+		config:      config,
+		stop:        make(chan chan struct{}),
+		trigger:     make(chan struct{}, 1),
+		buffer:      newLogBuffer(*config.BufferSizeLimitBytes),
+		enc:         newChunkEncoder(*config.BufferChunkSizeBytes, config.Format),
+		httpClient:  defaultRoundTripperClient(config.EndpointTimeout),
+		deadLetters: newDeadLetterStore(config.DeadLetterDir, config.Name),
+	}, nil
+}
+
+func (l *logDestination) Start() {
+	go l.loop()
+}
+
+func (l *logDestination) Stop(ctx context.Context) error {
+	err := l.flushDecisions(ctx)
+
+	done := make(chan struct{})
+	l.stop <- done
+	<-done
+	return err
+}
+
+func (l *logDestination) Log(event DecisionResult) {
+	if l.config.Filter != nil && !l.config.Filter(event) {
+		return
+	}
+
+	l.mtx.Lock()
+	l.encodeAndBufferEvent(event)
+	triggered := l.uploadTriggered()
+	l.mtx.Unlock()
+
+	if triggered {
+		l.triggerUpload()
+	}
+}
+
+// uploadTriggered reports whether the buffered events crossed one of the
+// configured upload thresholds. The caller must hold mtx.
+func (l *logDestination) uploadTriggered() bool {
+	if l.config.UploadTriggerEvents > 0 && l.events >= l.config.UploadTriggerEvents {
+		return true
+	}
+
+	// the encoder holds uncompressed events not yet cut into chunks, so
+	// count those as well to avoid waiting for a full chunk
+	size := l.buffer.Size() + int64(l.enc.bytesWritten)
+	return l.config.UploadTriggerBytes > 0 && size >= l.config.UploadTriggerBytes
+}
+
+// triggerUpload wakes the upload loop without blocking. If an upload is
+// already pending the trigger is coalesced into it.
+func (l *logDestination) triggerUpload() {
+	select {
+	case l.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns a snapshot of the buffer and upload state of the destination.
+func (l *logDestination) Status() DecisionLogStatus {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	status := DecisionLogStatus{
+		Destination:           l.config.Name,
+		BufferedChunks:        l.buffer.Len(),
+		BufferedBytes:         l.buffer.Size(),
+		Dropped:               l.dropped.Load(),
+		DeadLettered:          l.deadLettered.Load(),
+		LastSuccessfulUpload:  l.lastUpload,
+		ConsecutiveFailures:   l.consecutiveFailures,
+		CurrentBackoffSeconds: l.currentBackoff.Seconds(),
+	}
+
+	if l.config.MaxBacklogBytes > 0 && status.BufferedBytes > l.config.MaxBacklogBytes {
+		status.BacklogExceeded = true
+	}
+
+	return status
+}
+
+func (p *logDestination) flushDecisions(ctx context.Context) error {
+	slog.Info("flushing decision logs", slog.String("destination", p.config.Name))
+	done := make(chan bool)
+
+	go func(ctx context.Context, done chan bool) {
+		for ctx.Err() == nil {
+			if _, err := p.oneShot(ctx); err != nil {
+				// Wait some before retrying, but skip incrementing interval since we are shutting down
+				time.Sleep(1 * time.Second)
+			} else {
+				done <- true
+				return
+			}
+		}
+	}(ctx, done)
+
+	select {
+	case <-done:
+		slog.Info("all decisions in buffer uploaded.", slog.String("destination", p.config.Name))
+	case <-ctx.Done():
+		switch ctx.Err() {
+		case context.DeadlineExceeded, context.Canceled:
+			return fmt.Errorf("logger stopped with decisions possibly still in buffer")
+		}
+	}
+	return nil
+}
+
+func (l *logDestination) doOneShot(ctx context.Context) error {
+	uploaded, err := l.oneShot(ctx)
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if err != nil {
+		l.consecutiveFailures++
+		slog.Error("failed to upload decision logs", slog.String("destination", l.config.Name), slog.String("error", err.Error()))
+	} else if uploaded {
+		l.consecutiveFailures = 0
+		slog.Info("decision logs uploaded successfully", slog.String("destination", l.config.Name))
+	} else {
+		l.consecutiveFailures = 0
+		slog.Debug("log upload queue was empty.", slog.String("destination", l.config.Name))
+	}
+	return err
+}
+
+// oneShot uploads everything buffered so far. Chunks are uploaded in batches
+// of at most UploadConcurrency, so chunks within a batch may reach the
+// collector in any order, while batches are sent one after another. When a
+// batch has failures the remaining chunks are not attempted, and all chunks
+// not uploaded are put back at the front of the buffer in their original
+// order, ahead of anything logged during the upload. It reports whether the
+// collector acknowledged any chunk, in whole or in part, even if others
+// failed, and records the time of the upload if so.
+func (l *logDestination) oneShot(ctx context.Context) (uploaded bool, err error) {
+	// chunks being uploaded are neither in the buffer nor requeued yet, so
+	// without waiting a flush could find the buffer empty and finish early
+	l.uploadMtx.Lock()
+	defer l.uploadMtx.Unlock()
+
+	// Make a local copy of the encoder and buffer and create
+	// a new encoder and buffer. This is needed as locking the buffer for
+	// the upload duration will block policy evaluation and result in
+	// increased latency for clients
+	l.mtx.Lock()
+	oldChunkEnc := l.enc
+	oldBuffer := l.buffer
+	l.buffer = newLogBuffer(*l.config.BufferSizeLimitBytes)
+	l.enc = newChunkEncoder(*l.config.BufferChunkSizeBytes, l.config.Format)
+	l.events = 0
+	l.mtx.Unlock()
+
+	// Along with uploading the compressed events in the buffer
+	// to the remote server, flush any pending compressed data to the
+	// underlying writer and add to the buffer.
+	chunk, err := oldChunkEnc.Flush()
+	if err != nil {
+		return false, err
+	}
+
+	for _, ch := range chunk {
+		l.bufferChunk(oldBuffer, newLogChunk(ch))
+	}
+
+	if oldBuffer.Len() == 0 {
+		return false, nil
+	}
+
+	var chunks []*logChunk
+	for ch := oldBuffer.Pop(); ch != nil; ch = oldBuffer.Pop() {
+		chunks = append(chunks, ch)
+	}
+
+	var failed []*logChunk
+	acknowledged := 0
+	concurrency := *l.config.UploadConcurrency
+	for start := 0; start < len(chunks); start += concurrency {
+		end := start + concurrency
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+
+		if err != nil {
+			failed = append(failed, chunks[start:]...)
+			break
+		}
+
+		batch := chunks[start:end]
+		errs := make([]error, len(batch))
+		retries := make([]*logChunk, len(batch))
+
+		var wg sync.WaitGroup
+		for i := range batch {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				retries[i], errs[i] = l.uploadChunk(ctx, batch[i])
+			}(i)
+		}
+		wg.Wait()
+
+		for i := range batch {
+			// a chunk accepted in part comes back as a chunk of the rest
+			if retries[i] != batch[i] {
+				acknowledged++
+			}
+
+			if retries[i] == nil {
+				continue
+			}
+
+			retries[i].attempts = batch[i].attempts + 1
+			if l.shouldDeadLetter(retries[i], errs[i]) {
+				// given up on, so don't let it hold back the other chunks
+				l.deadLetter(retries[i], errs[i])
+				errs[i] = nil
+				continue
+			}
+
+			failed = append(failed, retries[i])
+		}
+		err = errors.Join(errs...)
+	}
+
+	l.mtx.Lock()
+	if len(failed) > 0 {
+		l.requeueChunks(failed)
+	}
+
+	// chunks acknowledged before a failure were still uploaded
+	if acknowledged > 0 {
+		l.lastUpload = time.Now().UTC()
+	}
+	l.mtx.Unlock()
+
+	return acknowledged > 0, err
+}
+
+// shouldDeadLetter reports whether to give up on a failed chunk, either
+// because the collector rejected it permanently or it ran out of attempts.
+func (l *logDestination) shouldDeadLetter(chunk *logChunk, err error) bool {
+	if isPermanentUploadError(err) {
+		return true
+	}
+
+	return l.config.MaxUploadAttempts > 0 && chunk.attempts >= l.config.MaxUploadAttempts
+}
+
+func (l *logDestination) deadLetter(chunk *logChunk, cause error) {
+	l.deadLettered.Add(1)
+
+	if l.config.DeadLetterDir == "" {
+		slog.Error("dropped decision log chunk after failed upload", slog.String("destination", l.config.Name), slog.String("chunk_id", chunk.id), slog.Int("attempts", chunk.attempts), slog.String("error", cause.Error()))
+		return
+	}
+
+	err := l.deadLetters.Put(chunk, cause)
+	if err != nil {
+		slog.Error("failed to dead-letter decision log chunk", slog.String("destination", l.config.Name), slog.String("chunk_id", chunk.id), slog.String("error", err.Error()))
+		return
+	}
+
+	slog.Warn("dead-lettered decision log chunk", slog.String("destination", l.config.Name), slog.String("chunk_id", chunk.id), slog.Int("attempts", chunk.attempts), slog.String("error", cause.Error()))
+}
+
+// DeadLetters lists the chunks stored in the dead-letter directory of the destination.
+func (l *logDestination) DeadLetters() ([]DeadLetterEntry, error) {
+	if l.config.DeadLetterDir == "" {
+		return nil, nil
+	}
+
+	return l.deadLetters.List()
+}
+
+// ReplayDeadLetters uploads the dead-lettered chunks again, oldest first.
+// Chunks keep their id, so collectors can deduplicate them. Replayed chunks are
+// removed, failed ones are kept with the new failure recorded.
+func (l *logDestination) ReplayDeadLetters(ctx context.Context) (replayed int, err error) {
+	entries, err := l.DeadLetters()
+	if err != nil {
+		return 0, err
+	}
+
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return replayed, errors.Join(err, ctx.Err())
+		}
+
+		chunk, _, getErr := l.deadLetters.Get(entry.ChunkID)
+		if getErr != nil {
+			err = errors.Join(err, getErr)
+			continue
+		}
+
+		retry, uploadErr := l.uploadChunk(ctx, chunk)
+		if retry != nil {
+			// keep what wasn't accepted, under its own id if it was split
+			retry.attempts = chunk.attempts + 1
+			err = errors.Join(err, uploadErr, l.deadLetters.Put(retry, uploadErr))
+			if retry == chunk {
+				continue
+			}
+		}
+
+		err = errors.Join(err, l.deadLetters.Delete(chunk.id))
+		if retry == nil {
+			replayed++
+		}
+	}
+
+	return replayed, err
+}
+
+// requeueChunks puts chunks back at the front of the buffer, ahead of any
+// chunks buffered since the upload started. The caller must hold mtx.
+func (l *logDestination) requeueChunks(chunks []*logChunk) {
+	buffer := newLogBuffer(*l.config.BufferSizeLimitBytes)
+	for _, ch := range chunks {
+		l.bufferChunk(buffer, ch)
+	}
+	for ch := l.buffer.Pop(); ch != nil; ch = l.buffer.Pop() {
+		l.bufferChunk(buffer, ch)
+	}
+
+	l.buffer = buffer
+}
+
+func (l *logDestination) loop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	var retry int
+
+	for {
+		var delay time.Duration
+		err := l.doOneShot(ctx)
+
+		if err == nil {
+			min := float64(*l.config.MinDelaySeconds)
+			max := float64(*l.config.MaxDelaySeconds)
+			delay = time.Duration(((max - min) * rand.Float64()) + min)
+		} else {
+			delay = util.DefaultBackoff(float64(minRetryDelay), float64(*l.config.MaxDelaySeconds), retry)
+		}
+
+		l.mtx.Lock()
+		if err != nil {
+			l.currentBackoff = delay
+		} else {
+			l.currentBackoff = 0
+		}
+		l.mtx.Unlock()
+
+		slog.Debug("waiting before next upload/retry.", slog.Duration("delay", delay))
+
+		// thresholds can cut the regular delay short, but never a retry
+		// backoff, as that would hammer a failing collector
+		trigger := l.trigger
+		if err != nil {
+			trigger = nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-trigger:
+			timer.Stop()
+			slog.Debug("upload threshold reached, uploading early.")
+		case done := <-l.stop:
+			timer.Stop()
+			cancel()
+			done <- struct{}{}
+			return
+		}
+
+		if err != nil {
+			retry++
+		} else {
+			retry = 0
+		}
+	}
+}
+
+func (l *logDestination) encodeAndBufferEvent(event DecisionResult) {
+	result, err := l.enc.Write(event)
+	if err != nil {
+		slog.Error("log encoding failed", slog.String("error", err.Error()))
+		return
+	}
+	for _, chunk := range result {
+		l.bufferChunk(l.buffer, newLogChunk(chunk))
+	}
+
+	l.events++
+}
+
+func (l *logDestination) bufferChunk(buffer *logBuffer, chunk *logChunk) {
+	dropped := buffer.Push(chunk)
+	if dropped > 0 {
+		l.dropped.Add(int64(dropped))
+		slog.Warn("Dropped chunks from buffer. Reduce reporting interval or increase buffer size.", slog.String("destination", l.config.Name), slog.Int("chunks", dropped))
+	}
+}
+
+// uploadChunk sends a chunk to the collector. The chunk ID is sent as an
+// idempotency key, so a collector can drop chunks it already accepted when a
+// retry follows a timed out upload. If the collector acknowledges only part of
+// the chunk, a new chunk holding the remaining events is returned for retry.
+// On failure the chunk itself is returned.
+func (l *logDestination) uploadChunk(ctx context.Context, chunk *logChunk) (*logChunk, error) {
+	body := bytes.NewReader(chunk.bs)
+	request, err := http.NewRequestWithContext(ctx, "POST", l.config.Endpoint, body)
+	if err != nil {
+		return chunk, err
+	}
+
+	request.Header.Add("Content-Type", contentType(l.config.Format))
+	request.Header.Add("Content-Encoding", "gzip")
+	request.Header.Add("Authorization", fmt.Sprintf("bearer %v", l.config.BearerToken))
+	request.Header.Add(ChunkIDHeader, chunk.id)
+
+	resp, err := l.httpClient.Do(request)
+	if err != nil {
+		return chunk, fmt.Errorf("log upload failed: %w", err)
+	}
+
+	defer closeHttp(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return chunk, &uploadStatusError{StatusCode: resp.StatusCode}
+	}
+
+	ack, err := readAck(resp)
+	if err != nil || ack.Accepted == nil {
+		// no (valid) acknowledgement, the whole chunk was accepted
+		return nil, nil
+	}
+
+	return remainingChunk(chunk, ack, l.config.Format)
+}
+
+// readAck parses an optional acknowledgement from the collector response.
+func readAck(resp *http.Response) (*DecisionLogAck, error) {
+	var ack DecisionLogAck
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return &ack, nil
+	}
+
+	err := json.NewDecoder(io.LimitReader(resp.Body, maxAckSizeBytes)).Decode(&ack)
+	if err != nil && err != io.EOF {
+		slog.Warn("failed to read log upload acknowledgement", slog.String("error", err.Error()))
+		return nil, err
+	}
+
+	return &ack, nil
+}
+
+// remainingChunk builds a chunk of the events the collector did not accept.
+func remainingChunk(chunk *logChunk, ack *DecisionLogAck, format string) (*logChunk, error) {
+	events, err := decodeChunk(chunk.bs, format)
+	if err != nil {
+		// we can't tell what is missing, so resend everything
+		return chunk, fmt.Errorf("log upload partially accepted, failed to decode chunk: %w", err)
+	}
+
+	accepted := make(map[string]struct{}, len(ack.Accepted))
+	for _, id := range ack.Accepted {
+		accepted[id] = struct{}{}
+	}
+
+	enc := newChunkEncoder(math.MaxInt64, format)
+	remaining := 0
+	for _, event := range events {
+		if _, ok := accepted[event.ID]; ok {
+			continue
+		}
+
+		if _, err := enc.Write(event); err != nil {
+			return chunk, err
+		}
+		remaining++
+	}
+
+	if remaining == 0 {
+		return nil, nil
+	}
+
+	result, err := enc.Flush()
+	if err != nil {
+		return chunk, err
+	}
+
+	return newLogChunk(result[0]), fmt.Errorf("log upload partially accepted: %d of %d events rejected", remaining, len(events))
+}
+
+func contentType(format string) string {
+	if format == LogFormatNDJSON {
+		return "application/x-ndjson"
+	}
+
+	return "application/json"
+}
+
+func defaultRoundTripperClient(timeout int) *http.Client {
+	// Ensure we use a http.Transport with proper settings: the zero values are not
+	// a good choice, as they cause leaking connections:
+	// https://github.com/golang/go/issues/19620
+
+	// copy, we don't want to alter the default client's Transport
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.ResponseHeaderTimeout = time.Duration(timeout) * time.Second
+
+	c := *http.DefaultClient
+	c.Transport = tr
+	return &c
+}
+
+func closeHttp(resp *http.Response) {
+	if resp != nil && resp.Body != nil {
+		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+			return
+		}
+		resp.Body.Close()
+	}
+}
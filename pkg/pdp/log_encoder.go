@@ -8,17 +8,20 @@ import (
 
 // chunkEncoder implements log buffer chunking and compression. Log events are
 // written to the encoder and the encoder outputs chunks that are fit to the
-// configured limit.
+// configured limit. Chunks hold either a json array of events, or newline
+// delimited events for the ndjson format.
 type chunkEncoder struct {
 	flushLimit   int64
+	format       string
 	bytesWritten int
 	buf          *bytes.Buffer
 	w            *gzip.Writer
 }
 
-func newChunkEncoder(limit int64) *chunkEncoder {
+func newChunkEncoder(limit int64, format string) *chunkEncoder {
 	enc := &chunkEncoder{
 		flushLimit: limit,
+		format:     format,
 	}
 	enc.update()
 
@@ -45,14 +48,15 @@ func (enc *chunkEncoder) Write(event DecisionResult) (result [][]byte, err error
 		result = enc.update()
 	}
 
-	if enc.bytesWritten == 0 {
-		n, err := enc.w.Write([]byte(`[`))
-		if err != nil {
-			return nil, err
+	// ndjson needs no separator, as the json encoder already terminates
+	// every event with a newline
+	if enc.format != LogFormatNDJSON {
+		separator := `,`
+		if enc.bytesWritten == 0 {
+			separator = `[`
 		}
-		enc.bytesWritten += n
-	} else {
-		n, err := enc.w.Write([]byte(`,`))
+
+		n, err := enc.w.Write([]byte(separator))
 		if err != nil {
 			return nil, err
 		}
@@ -69,8 +73,10 @@ func (enc *chunkEncoder) Write(event DecisionResult) (result [][]byte, err error
 }
 
 func (enc *chunkEncoder) writeClose() error {
-	if _, err := enc.w.Write([]byte(`]`)); err != nil {
-		return err
+	if enc.format != LogFormatNDJSON {
+		if _, err := enc.w.Write([]byte(`]`)); err != nil {
+			return err
+		}
 	}
 	return enc.w.Close()
 }
@@ -99,3 +105,31 @@ func (enc *chunkEncoder) initialize() {
 	enc.bytesWritten = 0
 	enc.w = gzip.NewWriter(enc.buf)
 }
+
+// decodeChunk reads back the events of a compressed chunk.
+func decodeChunk(bs []byte, format string) ([]DecisionResult, error) {
+	r, err := gzip.NewReader(bytes.NewReader(bs))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	var events []DecisionResult
+	dec := json.NewDecoder(r)
+	if format != LogFormatNDJSON {
+		if err := dec.Decode(&events); err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
+
+	for dec.More() {
+		var event DecisionResult
+		if err := dec.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -1,118 +1,90 @@
 package pdp
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"math/rand"
-	"net/http"
+	"path/filepath"
 	"sync"
-	"time"
 
 	"log/slog"
-
-	"github.com/patrickfnielsen/pdp-client/internal/util"
-)
-
-const (
-	minRetryDelay               = time.Millisecond * 100
-	defaultMinDelaySeconds      = int64(1)
-	defaultMaxDelaySeconds      = int64(10)
-	defaultBufferChunkSizeBytes = int64(32768) // 32KB limit
-	defaultBufferSizeLimitBytes = int64(0)     // unlimited
 )
 
 type DecisionLogConfig struct {
-	ConsoleLog           bool
-	HTTPLog              bool
-	BufferChunkSizeBytes *int64
-	BufferSizeLimitBytes *int64
-	MinDelaySeconds      *int64
-	MaxDelaySeconds      *int64
-	Endpoint             string
-	EndpointTimeout      int
-	BearerToken          string
+	ConsoleLog   bool
+	HTTPLog      bool
+	Destinations []DecisionLogDestination // destinations to upload decision logs to when HTTPLog is enabled
 }
 
-func (c *DecisionLogConfig) validateAndInjectDefaults() error {
-	min := defaultMinDelaySeconds
-	max := defaultMaxDelaySeconds
-
-	// reject bad min/max values
-	if c.MaxDelaySeconds != nil && c.MinDelaySeconds != nil {
-		if *c.MaxDelaySeconds < *c.MinDelaySeconds {
-			return fmt.Errorf("max reporting delay must be >= min reporting delay in decision_logs")
-		}
-		min = *c.MinDelaySeconds
-		max = *c.MaxDelaySeconds
-	} else if c.MaxDelaySeconds == nil && c.MinDelaySeconds != nil {
-		return fmt.Errorf("reporting configuration missing 'max_delay_seconds' in decision_logs")
-	} else if c.MinDelaySeconds == nil && c.MaxDelaySeconds != nil {
-		return fmt.Errorf("reporting configuration missing 'min_delay_seconds' in decision_logs")
-	}
-
-	// scale to seconds
-	minSeconds := int64(time.Duration(min) * time.Second)
-	c.MinDelaySeconds = &minSeconds
-
-	maxSeconds := int64(time.Duration(max) * time.Second)
-	c.MaxDelaySeconds = &maxSeconds
+// decisionLogger writes decision logs to the console, and fans them out to
+// every configured destination.
+type decisionLogger struct {
+	config       *DecisionLogConfig
+	destinations []*logDestination
+}
 
-	// default the upload size limit
-	uploadLimit := defaultBufferChunkSizeBytes
-	if c.BufferChunkSizeBytes != nil {
-		uploadLimit = *c.BufferChunkSizeBytes
+func newLogger(config *DecisionLogConfig) (*decisionLogger, error) {
+	logger := &decisionLogger{config: config}
+	if !config.HTTPLog {
+		return logger, nil
 	}
 
-	c.BufferChunkSizeBytes = &uploadLimit
-
-	// default the buffer size limit
-	bufferLimit := defaultBufferSizeLimitBytes
-	if c.BufferSizeLimitBytes != nil {
-		bufferLimit = *c.BufferSizeLimitBytes
-	}
+	names := make(map[string]struct{}, len(config.Destinations))
+	deadLetterDirs := make(map[string]string, len(config.Destinations))
+	for i := range config.Destinations {
+		destination, err := newLogDestination(&config.Destinations[i])
+		if err != nil {
+			return nil, err
+		}
 
-	c.BufferSizeLimitBytes = &bufferLimit
+		name := destination.config.Name
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicate decision log destination: %s", name)
+		}
 
-	return nil
-}
+		// a replay uploads every chunk in the directory, so a shared directory
+		// would send the chunks of one destination to the other
+		if dir := destination.config.DeadLetterDir; dir != "" {
+			dir, err := filepath.Abs(dir)
+			if err != nil {
+				return nil, err
+			}
 
-type decisionLogger struct {
-	config     *DecisionLogConfig
-	buffer     *logBuffer
-	enc        *chunkEncoder
-	httpClient *http.Client
-	mtx        sync.Mutex
-	stop       chan chan struct{}
-}
+			if other, ok := deadLetterDirs[dir]; ok {
+				return nil, fmt.Errorf("decision log destinations %s and %s share the dead-letter directory %s", other, name, dir)
+			}
+			deadLetterDirs[dir] = name
+		}
 
-func newLogger(config *DecisionLogConfig) (*decisionLogger, error) {
-	err := config.validateAndInjectDefaults()
-	if err != nil {
-		return nil, err
+		names[name] = struct{}{}
+		logger.destinations = append(logger.destinations, destination)
 	}
 
-	return &decisionLogger{
-		config:     config,
-		stop:       make(chan chan struct{}),
-		buffer:     newLogBuffer(*config.BufferSizeLimitBytes),
-		enc:        newChunkEncoder(*config.BufferChunkSizeBytes),
-		httpClient: defaultRoundTripperClient(config.EndpointTimeout),
-	}, nil
+	return logger, nil
 }
 
 func (l *decisionLogger) Start() {
-	go l.loop()
+	for _, d := range l.destinations {
+		d.Start()
+	}
 }
 
+// Stop flushes and stops all destinations in parallel, so a slow destination
+// doesn't use up the shutdown time of the others.
 func (l *decisionLogger) Stop(ctx context.Context) error {
-	err := l.flushDecisions(ctx)
+	errs := make([]error, len(l.destinations))
 
-	done := make(chan struct{})
-	l.stop <- done
-	<-done
-	return err
+	var wg sync.WaitGroup
+	for i, d := range l.destinations {
+		wg.Add(1)
+		go func(i int, d *logDestination) {
+			defer wg.Done()
+			errs[i] = d.Stop(ctx)
+		}(i, d)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
 }
 
 func (l *decisionLogger) Log(event DecisionResult) error {
@@ -120,210 +92,48 @@ func (l *decisionLogger) Log(event DecisionResult) error {
 		l.logEventConsole(event)
 	}
 
-	if l.config.HTTPLog {
-		l.mtx.Lock()
-		l.encodeAndBufferEvent(event)
-		l.mtx.Unlock()
+	for _, d := range l.destinations {
+		d.Log(event)
 	}
 
 	return nil
 }
 
-func (p *decisionLogger) flushDecisions(ctx context.Context) error {
-	slog.Info("flushing decision logs")
-	done := make(chan bool)
-
-	go func(ctx context.Context, done chan bool) {
-		for ctx.Err() == nil {
-			if _, err := p.oneShot(ctx); err != nil {
-				// Wait some before retrying, but skip incrementing interval since we are shutting down
-				time.Sleep(1 * time.Second)
-			} else {
-				done <- true
-				return
-			}
-		}
-	}(ctx, done)
-
-	select {
-	case <-done:
-		slog.Info("all decisions in buffer uploaded.")
-	case <-ctx.Done():
-		switch ctx.Err() {
-		case context.DeadlineExceeded, context.Canceled:
-			return fmt.Errorf("logger stopped with decisions possibly still in buffer")
-		}
+func (l *decisionLogger) Status() DecisionLoggerStatus {
+	status := DecisionLoggerStatus{Destinations: []DecisionLogStatus{}}
+	for _, d := range l.destinations {
+		status.Destinations = append(status.Destinations, d.Status())
 	}
-	return nil
-}
-
-func (l *decisionLogger) doOneShot(ctx context.Context) error {
-	uploaded, err := l.oneShot(ctx)
 
-	l.mtx.Lock()
-	defer l.mtx.Unlock()
-
-	if err != nil {
-		slog.Error("failed to upload decision logs", slog.String("error", err.Error()))
-	} else if uploaded {
-		slog.Info("decision logs uploaded successfully")
-	} else {
-		slog.Debug("log upload queue was empty.")
-	}
-	return err
+	return status
 }
 
-func (l *decisionLogger) oneShot(ctx context.Context) (ok bool, err error) {
-	// Make a local copy of the encoder and buffer and create
-	// a new encoder and buffer. This is needed as locking the buffer for
-	// the upload duration will block policy evaluation and result in
-	// increased latency for clients
-	l.mtx.Lock()
-	oldChunkEnc := l.enc
-	oldBuffer := l.buffer
-	l.buffer = newLogBuffer(*l.config.BufferSizeLimitBytes)
-	l.enc = newChunkEncoder(*l.config.BufferChunkSizeBytes)
-	l.mtx.Unlock()
-
-	// Along with uploading the compressed events in the buffer
-	// to the remote server, flush any pending compressed data to the
-	// underlying writer and add to the buffer.
-	chunk, err := oldChunkEnc.Flush()
-	if err != nil {
-		return false, err
-	}
-
-	for _, ch := range chunk {
-		l.bufferChunk(oldBuffer, ch)
-	}
-
-	if oldBuffer.Len() == 0 {
-		return false, nil
-	}
-
-	for bs := oldBuffer.Pop(); bs != nil; bs = oldBuffer.Pop() {
-		if err == nil {
-			err = l.uploadChunk(ctx, bs)
-		}
+func (l *decisionLogger) DeadLetters() ([]DeadLetterEntry, error) {
+	var entries []DeadLetterEntry
+	for _, d := range l.destinations {
+		e, err := d.DeadLetters()
 		if err != nil {
-			l.mtx.Lock()
-			l.bufferChunk(l.buffer, bs)
-			l.mtx.Unlock()
-		}
-	}
-
-	return err == nil, err
-}
-
-func (l *decisionLogger) loop() {
-	ctx, cancel := context.WithCancel(context.Background())
-	var retry int
-
-	for {
-		var delay time.Duration
-		var waitC chan struct{}
-		err := l.doOneShot(ctx)
-
-		if err == nil {
-			min := float64(*l.config.MinDelaySeconds)
-			max := float64(*l.config.MaxDelaySeconds)
-			delay = time.Duration(((max - min) * rand.Float64()) + min)
-		} else {
-			delay = util.DefaultBackoff(float64(minRetryDelay), float64(*l.config.MaxDelaySeconds), retry)
+			return nil, err
 		}
 
-		slog.Debug("waiting before next upload/retry.", slog.Duration("delay", delay))
-
-		waitC = make(chan struct{})
-		go func() {
-			select {
-			case <-time.After(delay):
-				if err != nil {
-					retry++
-				} else {
-					retry = 0
-				}
-				close(waitC)
-			case <-ctx.Done():
-			}
-		}()
-
-		select {
-		case <-waitC:
-		case done := <-l.stop:
-			cancel()
-			done <- struct{}{}
-			return
-		}
+		entries = append(entries, e...)
 	}
-}
 
-func (l *decisionLogger) encodeAndBufferEvent(event DecisionResult) {
-	result, err := l.enc.Write(event)
-	if err != nil {
-		slog.Error("log encoding failed", slog.String("error", err.Error()))
-		return
-	}
-	for _, chunk := range result {
-		l.bufferChunk(l.buffer, chunk)
-	}
+	return entries, nil
 }
 
-func (l *decisionLogger) bufferChunk(buffer *logBuffer, bs []byte) {
-	dropped := buffer.Push(bs)
-	if dropped > 0 {
-		slog.Warn("Dropped chunks from buffer. Reduce reporting interval or increase buffer size.", slog.Int("chunks", dropped))
+func (l *decisionLogger) ReplayDeadLetters(ctx context.Context) (int, error) {
+	var replayed int
+	var err error
+	for _, d := range l.destinations {
+		n, replayErr := d.ReplayDeadLetters(ctx)
+		replayed += n
+		err = errors.Join(err, replayErr)
 	}
+
+	return replayed, err
 }
 
 func (l *decisionLogger) logEventConsole(event DecisionResult) {
 	slog.Info("decision log", slog.Any("decision", event))
 }
-
-func (l *decisionLogger) uploadChunk(ctx context.Context, data []byte) error {
-	body := bytes.NewReader(data)
-	request, err := http.NewRequestWithContext(ctx, "POST", l.config.Endpoint, body)
-	if err != nil {
-		return err
-	}
-
-	request.Header.Add("Content-Type", "application/json")
-	request.Header.Add("Content-Encoding", "gzip")
-	request.Header.Add("Authorization", fmt.Sprintf("bearer %v", l.config.BearerToken))
-
-	resp, err := l.httpClient.Do(request)
-	if err != nil {
-		return fmt.Errorf("log upload failed: %w", err)
-	}
-
-	defer closeHttp(resp)
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("log upload invalid status code: %d", resp.StatusCode)
-	}
-
-	return nil
-}
-
-func defaultRoundTripperClient(timeout int) *http.Client {
-	// Ensure we use a http.Transport with proper settings: the zero values are not
-	// a good choice, as they cause leaking connections:
-	// https://github.com/golang/go/issues/19620
-
-	// copy, we don't want to alter the default client's Transport
-	tr := http.DefaultTransport.(*http.Transport).Clone()
-	tr.ResponseHeaderTimeout = time.Duration(timeout) * time.Second
-
-	c := *http.DefaultClient
-	c.Transport = tr
-	return &c
-}
-
-func closeHttp(resp *http.Response) {
-	if resp != nil && resp.Body != nil {
-		if _, err := io.Copy(io.Discard, resp.Body); err != nil {
-			return
-		}
-		resp.Body.Close()
-	}
-}
@@ -0,0 +1,209 @@
+package pdp_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp/pdptest"
+)
+
+// uploadRecorder records the chunk ID of every upload before passing it to
+// the collector.
+type uploadRecorder struct {
+	collector http.Handler
+	loseFirst bool // drop the response to the first upload, after the collector handled it
+
+	mtx      sync.Mutex
+	chunkIDs []string
+}
+
+func (u *uploadRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mtx.Lock()
+	u.chunkIDs = append(u.chunkIDs, r.Header.Get(pdp.ChunkIDHeader))
+	first := len(u.chunkIDs) == 1
+	u.mtx.Unlock()
+
+	if first && u.loseFirst {
+		u.collector.ServeHTTP(httptest.NewRecorder(), r)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+
+	u.collector.ServeHTTP(w, r)
+}
+
+func (u *uploadRecorder) uploads() []string {
+	u.mtx.Lock()
+	defer u.mtx.Unlock()
+
+	return append([]string(nil), u.chunkIDs...)
+}
+
+// logDecisions makes the decisions with a client logging to the endpoint, and
+// closes the client to flush the decision logs. The destination can be
+// adjusted with configure.
+func logDecisions(t *testing.T, endpoint string, decisions int, configure func(*pdp.DecisionLogDestination)) *pdp.PermitClient {
+	t.Helper()
+
+	delay := int64(60)
+	destination := pdp.DecisionLogDestination{
+		Endpoint:        endpoint,
+		MinDelaySeconds: &delay,
+		MaxDelaySeconds: &delay,
+	}
+	if configure != nil {
+		configure(&destination)
+	}
+
+	permit, err := pdp.New(&pdp.PermitConfig{
+		Logger: pdp.DecisionLogConfig{
+			HTTPLog:      true,
+			Destinations: []pdp.DecisionLogDestination{destination},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	err = permit.ActivateBundles(ctx, []pdp.PolicyBundle{{Name: "app", Data: []byte("package app\n\nallow := true\n")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < decisions; i++ {
+		if _, err := permit.Decision(ctx, pdp.DecisionOptions{Path: "app/allow"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if err := permit.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	return permit
+}
+
+func TestLoggerFullAck(t *testing.T) {
+	collector := pdptest.NewCollector()
+	recorder := &uploadRecorder{collector: collector}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	logDecisions(t, server.URL, 3, nil)
+
+	if got := len(collector.Events()); got != 3 {
+		t.Fatalf("expected 3 events, got %d", got)
+	}
+
+	if got := len(recorder.uploads()); got != 1 {
+		t.Fatalf("expected a single upload, got %d", got)
+	}
+
+	if got := collector.Duplicates(); got != 0 {
+		t.Fatalf("expected no duplicates, got %d", got)
+	}
+}
+
+func TestLoggerPartialAck(t *testing.T) {
+	collector := pdptest.NewCollector()
+	collector.AcceptLimit = 1
+	recorder := &uploadRecorder{collector: collector}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	logDecisions(t, server.URL, 3, nil)
+
+	// every upload is acknowledged in part, and the remainder requeued as a
+	// new chunk until all events are accepted
+	if got := len(collector.Events()); got != 3 {
+		t.Fatalf("expected 3 events, got %d", got)
+	}
+
+	uploads := recorder.uploads()
+	if len(uploads) != 3 {
+		t.Fatalf("expected 3 uploads, got %d", len(uploads))
+	}
+
+	if uploads[0] == uploads[1] || uploads[1] == uploads[2] {
+		t.Fatalf("expected the remainders to be uploaded as new chunks, got %v", uploads)
+	}
+
+	if got := collector.Duplicates(); got != 0 {
+		t.Fatalf("expected no duplicates, got %d", got)
+	}
+}
+
+func TestLoggerPartialAckRecordsUpload(t *testing.T) {
+	collector := pdptest.NewCollector()
+	collector.AcceptLimit = 1
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	// the rest of the chunk is given up on right away, so the upload that
+	// was only accepted in part is the last one
+	permit := logDecisions(t, server.URL, 3, func(d *pdp.DecisionLogDestination) {
+		d.MaxUploadAttempts = 1
+	})
+
+	if got := len(collector.Events()); got != 1 {
+		t.Fatalf("expected 1 event, got %d", got)
+	}
+
+	status := permit.LoggerStatus().Destinations[0]
+	if status.LastSuccessfulUpload.IsZero() {
+		t.Fatal("expected the partially accepted upload to be recorded")
+	}
+
+	if status.DeadLettered != 1 {
+		t.Fatalf("expected the rest of the chunk to be given up on, got %d", status.DeadLettered)
+	}
+}
+
+func TestLoggerDuplicateRetry(t *testing.T) {
+	collector := pdptest.NewCollector()
+	recorder := &uploadRecorder{collector: collector, loseFirst: true}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	logDecisions(t, server.URL, 3, nil)
+
+	// the retry of a chunk whose response was lost carries the same chunk ID,
+	// so the collector drops it instead of storing the events twice
+	uploads := recorder.uploads()
+	if len(uploads) != 2 || uploads[0] != uploads[1] || uploads[0] == "" {
+		t.Fatalf("expected the chunk to be retried with the same ID, got %v", uploads)
+	}
+
+	if got := len(collector.Events()); got != 3 {
+		t.Fatalf("expected 3 events, got %d", got)
+	}
+
+	if got := collector.Duplicates(); got != 1 {
+		t.Fatalf("expected 1 duplicate, got %d", got)
+	}
+}
+
+func TestLoggerSharedDeadLetterDir(t *testing.T) {
+	dir := t.TempDir()
+	_, err := pdp.New(&pdp.PermitConfig{
+		Logger: pdp.DecisionLogConfig{
+			HTTPLog: true,
+			Destinations: []pdp.DecisionLogDestination{
+				{Name: "a", Endpoint: "http://localhost/a", DeadLetterDir: dir},
+				{Name: "b", Endpoint: "http://localhost/b", DeadLetterDir: dir + "/"},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected destinations sharing a dead-letter directory to be refused")
+	}
+}
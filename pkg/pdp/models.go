@@ -2,18 +2,26 @@ package pdp
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"log/slog"
+
+	"github.com/open-policy-agent/opa/topdown"
 )
 
 type DecisionResult struct {
-	ID          string      `json:"decisionId"`  // a unique identifier for this decision (which is included in the decision log.)
-	Result      interface{} `json:"result"`      // the output of query evaluation.
-	Path        string      `json:"path"`        // the path of query evaluation.
-	Input       interface{} `json:"input"`       // the path of query evaluation.
-	RequestedBy string      `json:"requestedBy"` // the client remote ip address
-	Timestamp   time.Time   `json:"timestamp"`   // timestamp of decision
+	ID          string      `json:"decisionId"`            // a unique identifier for this decision (which is included in the decision log.)
+	Result      interface{} `json:"result"`                // the output of query evaluation.
+	Path        string      `json:"path"`                  // the path of query evaluation.
+	Input       interface{} `json:"input"`                 // the path of query evaluation.
+	RequestedBy string      `json:"requestedBy"`           // the client remote ip address
+	Environment string      `json:"environment,omitempty"` // the environment whose policies were evaluated
+	Revision    string      `json:"revision,omitempty"`    // the policy revision the decision was made with, if activated with one
+	Timestamp   time.Time   `json:"timestamp"`             // timestamp of decision
+
+	Explanation []*topdown.Event       `json:"-"` // the trace of the evaluation, if an explain mode was given
+	Metrics     map[string]interface{} `json:"-"` // the evaluation metrics, if requested
 }
 
 func (n DecisionResult) LogValue() slog.Value {
@@ -23,13 +31,63 @@ func (n DecisionResult) LogValue() slog.Value {
 		slog.String("path", n.Path),
 		slog.Any("input", n.Input),
 		slog.String("requested_by", n.RequestedBy),
+		slog.String("environment", n.Environment),
+		slog.String("revision", n.Revision),
 		slog.Time("timestamp", n.Timestamp))
 }
 
+type DecisionLoggerStatus struct {
+	Destinations []DecisionLogStatus `json:"destinations"`
+}
+
+// BacklogExceeded reports whether any destination has more buffered than its
+// configured backlog limit.
+func (s DecisionLoggerStatus) BacklogExceeded() bool {
+	for _, d := range s.Destinations {
+		if d.BacklogExceeded {
+			return true
+		}
+	}
+
+	return false
+}
+
+type DecisionLogStatus struct {
+	Destination           string    `json:"destination"`           // name of the destination
+	BufferedChunks        int       `json:"bufferedChunks"`        // number of compressed chunks waiting for upload
+	BufferedBytes         int64     `json:"bufferedBytes"`         // size of the chunks waiting for upload
+	Dropped               int64     `json:"dropped"`               // total number of chunks dropped because the buffer was full
+	LastSuccessfulUpload  time.Time `json:"lastSuccessfulUpload"`  // time of the last successful upload, zero if none
+	ConsecutiveFailures   int       `json:"consecutiveFailures"`   // number of failed uploads since the last success
+	CurrentBackoffSeconds float64   `json:"currentBackoffSeconds"` // seconds before the next retry, zero if not retrying
+	BacklogExceeded       bool      `json:"backlogExceeded"`       // true when the buffered bytes exceed the configured backlog limit
+	DeadLettered          int64     `json:"deadLettered"`          // total number of chunks given up on since start
+}
+
+type DeadLetterEntry struct {
+	Destination string    `json:"destination"` // name of the destination the chunk was for
+	ChunkID     string    `json:"chunkId"`     // the id of the chunk, also used as idempotency key on replay
+	StatusCode  int       `json:"statusCode"`  // the last collector status code, 0 if the upload failed without a response
+	Error       string    `json:"error"`       // the last upload error
+	Attempts    int       `json:"attempts"`    // number of failed uploads
+	Timestamp   time.Time `json:"timestamp"`   // when the chunk was dead-lettered
+	Size        int64     `json:"size"`        // size of the compressed chunk
+}
+
+// DecisionLogAck is the optional body a collector can respond with to
+// acknowledge a partially accepted chunk. Events not listed in Accepted are
+// uploaded again. An empty body, or one without Accepted, accepts the chunk.
+type DecisionLogAck struct {
+	Accepted []string `json:"accepted"` // decision ids of the accepted events
+}
+
 type DecisionOptions struct {
-	RemoteAddr string      // specifies client remote ip address
-	Path       string      // specifies name of policy decision to evaluate (e.g., example/allow)
-	Input      interface{} // specifies value of the input document to evaluate policy with
+	RemoteAddr  string      // specifies client remote ip address
+	Path        string      // specifies name of policy decision to evaluate (e.g., example/allow)
+	Input       interface{} // specifies value of the input document to evaluate policy with
+	Environment string      // specifies the environment whose policies are evaluated, empty for the default
+	Explain     string      // specifies the trace to return: notes, fails, full or debug, empty for none
+	Metrics     bool        // specifies whether to return evaluation metrics
 }
 
 type DecisionUser struct {
@@ -48,14 +106,139 @@ type PolicyProjectUpdate struct {
 	Available bool
 	OldHash   string
 	NewHash   string
+	Ref       string // the branch or tag resolved to NewHash, or the pinned commit
+
+	revision *PolicyRevision
+}
+
+// PolicyRevision identifies a version of the policies of a source.
+type PolicyRevision struct {
+	Ref    string        `json:"ref"`              // what the source follows, e.g. a branch or a directory
+	Hash   string        `json:"hash"`             // identifies the content, e.g. a commit
+	Commit *PolicyCommit `json:"commit,omitempty"` // the commit, for git sources once loaded
+}
+
+type PolicyCommit struct {
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+}
+
+// PolicyUpdateEvent describes an activation of new policies, and whether it
+// succeeded.
+type PolicyUpdateEvent struct {
+	Timestamp   time.Time            `json:"timestamp"`
+	OldRevision string               `json:"oldRevision"` // the previously active revision, for a composer the composite revision
+	NewRevision string               `json:"newRevision"`
+	Sources     []PolicySourceChange `json:"sources"` // the sources whose revision changed
+	Added       []PolicyModuleChange `json:"added"`
+	Modified    []PolicyModuleChange `json:"modified"`
+	Removed     []PolicyModuleChange `json:"removed"`
+	Error       string               `json:"error,omitempty"` // why the activation failed, empty if the policies are active
+}
+
+type PolicySourceChange struct {
+	Source      string         `json:"source"`
+	OldRevision PolicyRevision `json:"oldRevision"`
+	NewRevision PolicyRevision `json:"newRevision"`
+}
+
+type PolicyModuleChange struct {
+	Name    string `json:"name"`
+	OldHash string `json:"oldHash,omitempty"` // sha-256 of the previous content, empty if added
+	NewHash string `json:"newHash,omitempty"` // sha-256 of the new content, empty if removed
 }
 
 type PolicyProject struct {
-	Url           string
-	Branch        string
-	SSHKey        []byte
-	Hash          string
-	PolicyBundles []PolicyBundle
+	Name         string // identifies the project when composed with others, defaults to the url
+	Url          string
+	Mount        string // package prefix the project owns when composed, e.g. platform.lib, empty owns any package not owned by another project
+	Branch       string // branch to follow, unless a tag, version or commit is set
+	Tag          string // follow the newest tag matching this pattern, e.g. v1.4.*
+	Version      string // follow the newest tag matching this semver constraint, e.g. ~1.4 or >=1.4, <2
+	Commit       string // load this commit (full sha-1) and never update
+	Auth         PolicyAuth
+	Trust        PolicyTrust   // keys revisions must be signed by, if any
+	Root         string        // directory policies are loaded from, module names are relative to it
+	Include      []string      // globs of policy files to load, relative to Root, empty loads all
+	Exclude      []string      // globs of files and directories to skip, relative to Root
+	CacheDir     string        // directory for an on-disk repository cache, if empty every update clones into memory
+	PollInterval time.Duration // how often to check for updates, defaults to a minute
+	PollJitter   float64       // randomizes the poll interval by up to this fraction, e.g. 0.1 for +/-10%
+}
+
+// PolicyDirectory is a directory on the local filesystem to load policies
+// from, e.g. a ConfigMap volume.
+type PolicyDirectory struct {
+	Name     string        // identifies the directory when composed with others, defaults to the path
+	Path     string        // module names are relative to it
+	Include  []string      // globs of policy files to load, relative to Path, empty loads all
+	Exclude  []string      // globs of files and directories to skip, relative to Path
+	Debounce time.Duration // how long to wait for changes to settle before loading them, defaults to 500ms
+}
+
+// PolicyBundleEndpoint is an url to download an OPA bundle (bundle.tar.gz)
+// from.
+type PolicyBundleEndpoint struct {
+	Name            string // identifies the bundle when composed with others, defaults to the url
+	Url             string
+	BearerToken     string
+	Timeout         time.Duration       // request timeout, defaults to 30 seconds
+	LongPollTimeout time.Duration       // how long the server may hold a request until the bundle changes, zero disables long polling
+	Verification    *BundleVerification // keys the bundle must be signed with, if nil signatures aren't verified
+}
+
+// BundleVerification configures the keys OPA bundle signatures
+// (.signatures.json) are verified with.
+type BundleVerification struct {
+	Keys    []BundleKey
+	KeyID   string   // key to verify with, if empty the key id of the signature is used
+	Scope   string   // scope the signature must have, if empty the scope of the key
+	Exclude []string // files not covered by the signature
+}
+
+type BundleKey struct {
+	ID        string
+	Algorithm string // e.g. RS256, ES256 or HS256, defaults to RS256
+	Key       string // PEM encoded public key, or the secret for HS algorithms
+	Scope     string
+}
+
+// MountedSource is a policy source composed with others, owning the packages
+// below its mount.
+type MountedSource struct {
+	Source       PolicySource
+	Mount        string        // package prefix the source owns, e.g. platform.lib, empty owns any package not owned by another source
+	PollInterval time.Duration // how often to check for updates, defaults to a minute
+	PollJitter   float64       // randomizes the poll interval by up to this fraction
+}
+
+// PolicyComposer merges the policies of several sources, and activates them
+// as one set.
+type PolicyComposer struct {
+	eventHandlerFunc func(context.Context, string, []PolicyBundle) error
+	subscribers      []func(context.Context, PolicyUpdateEvent)
+	sources          []*composedSource
+	stop             chan struct{}
+	stopOnce         sync.Once
+	mtx              sync.Mutex
+	holding          bool
+	revision         string
+	bundles          []PolicyBundle
+	lastError        string
+}
+
+type composedSource struct {
+	name      string
+	mount     []string
+	updater   *PolicyUpdater
+	revision  PolicyRevision // the latest revision loaded
+	activated PolicyRevision // the revision in the active composition
+	bundles   []PolicyBundle
+	loaded    bool
+
+	activatedBundles []PolicyBundle // the policies of the activated revision
 }
 
 type PolicyBundle struct {
@@ -64,6 +247,67 @@ type PolicyBundle struct {
 }
 
 type PolicyUpdater struct {
-	eventHandlerFunc func(context.Context, []PolicyBundle)
-	project          PolicyProject
+	activateFunc        func(context.Context, *PolicyRevision, []PolicyBundle) error
+	subscribers         []func(context.Context, PolicyUpdateEvent)
+	source              PolicySource
+	pollInterval        time.Duration
+	pollJitter          float64
+	trigger             chan struct{}
+	stop                chan struct{}
+	stopOnce            sync.Once
+	updateMtx           sync.Mutex    // serializes updates
+	mtx                 sync.Mutex    // guards the fields below
+	done                chan struct{} // closed when Start returns, nil until started
+	revision            PolicyRevision
+	bundles             []PolicyBundle
+	lastAttempt         time.Time
+	lastSuccess         time.Time
+	lastError           string
+	consecutiveFailures int
+	currentBackoff      time.Duration
+}
+
+type PolicyUpdaterStatus struct {
+	Source                string    `json:"source"`                // name of the source
+	Ref                   string    `json:"ref"`                   // what the active revision was resolved from, e.g. a branch
+	Hash                  string    `json:"hash"`                  // the active revision, empty if nothing was loaded
+	LastAttempt           time.Time `json:"lastAttempt"`           // time of the last update check, zero if none
+	LastSuccess           time.Time `json:"lastSuccess"`           // time of the last successful update check, zero if none
+	LastError             string    `json:"lastError"`             // why the last update failed, empty after a success
+	ConsecutiveFailures   int       `json:"consecutiveFailures"`   // number of failed updates since the last success
+	CurrentBackoffSeconds float64   `json:"currentBackoffSeconds"` // seconds before the next retry, zero if not retrying
+	Modules               []string  `json:"modules"`               // names of the active modules
+}
+
+type PolicyComposerStatus struct {
+	Revision  string                `json:"revision"`  // the active composite revision, empty until every source is loaded
+	LastError string                `json:"lastError"` // why the last composition failed, empty after a success
+	Sources   []PolicyUpdaterStatus `json:"sources"`
+}
+
+// HistoricalRevision selects past policies by commit or time. With a commit,
+// the source with the commit is loaded at it, and the other sources as they
+// were when it was committed. Otherwise every source is loaded as it was at
+// the time.
+type HistoricalRevision struct {
+	Source string    // the source the commit belongs to, required with several git sources
+	Commit string    // a commit hash, full or abbreviated
+	Time   time.Time // used when no commit is given
+}
+
+type HistoricalDecision struct {
+	Revision string                    `json:"revision"` // the composite revision of the past policies
+	Sources  map[string]PolicyRevision `json:"sources"`  // the revision of every source, by name
+	Result   DecisionResult            `json:"result"`
+}
+
+type SignatureStatus struct {
+	Required        bool      `json:"required"`        // whether revisions must be signed by a trusted key
+	Signer          string    `json:"signer"`          // the key that signed the last verified revision
+	VerifiedHash    string    `json:"verifiedHash"`    // the last verified commit
+	Verifications   int64     `json:"verifications"`   // number of revisions verified since start
+	Refusals        int64     `json:"refusals"`        // number of revisions refused since start
+	LastRefusal     string    `json:"lastRefusal"`     // why the last refused revision was refused
+	LastRefusedHash string    `json:"lastRefusedHash"` // the last refused commit
+	LastRefusalTime time.Time `json:"lastRefusalTime"` // when the last revision was refused
 }
@@ -0,0 +1,138 @@
+// Package pdptest provides utilities for testing code that uses the pdp package.
+package pdptest
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/patrickfnielsen/pdp-client/pkg/pdp"
+)
+
+// Collector is a reference decision log collector. It deduplicates uploads
+// by chunk ID and events by decision ID, and can be configured to accept only
+// part of each chunk to exercise partial acknowledgements.
+//
+// Use it with httptest.NewServer(pdptest.NewCollector()).
+type Collector struct {
+	// AcceptLimit caps the number of new events accepted per chunk, the rest
+	// are left out of the acknowledgement. 0 accepts everything.
+	AcceptLimit int
+
+	// StatusCode, when set, is returned for every upload without reading it.
+	StatusCode int
+
+	mtx        sync.Mutex
+	chunks     map[string]struct{}
+	seen       map[string]struct{}
+	events     []pdp.DecisionResult
+	duplicates int
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		chunks: map[string]struct{}{},
+		seen:   map[string]struct{}{},
+	}
+}
+
+func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.StatusCode != 0 {
+		w.WriteHeader(c.StatusCode)
+		return
+	}
+
+	// a retried chunk we already accepted in full
+	id := r.Header.Get(pdp.ChunkIDHeader)
+	if _, ok := c.chunks[id]; ok && id != "" {
+		c.duplicates++
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	events, err := readEvents(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ack := pdp.DecisionLogAck{Accepted: []string{}}
+	accepted := 0
+	for _, event := range events {
+		if _, ok := c.seen[event.ID]; ok {
+			c.duplicates++
+			ack.Accepted = append(ack.Accepted, event.ID)
+			continue
+		}
+
+		if c.AcceptLimit > 0 && accepted >= c.AcceptLimit {
+			continue
+		}
+
+		c.seen[event.ID] = struct{}{}
+		c.events = append(c.events, event)
+		ack.Accepted = append(ack.Accepted, event.ID)
+		accepted++
+	}
+
+	if len(ack.Accepted) == len(events) && id != "" {
+		c.chunks[id] = struct{}{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(ack)
+}
+
+// Events returns the unique events received so far, in the order they arrived.
+func (c *Collector) Events() []pdp.DecisionResult {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return append([]pdp.DecisionResult(nil), c.events...)
+}
+
+// Duplicates returns the number of chunks and events that were received again
+// after already being accepted.
+func (c *Collector) Duplicates() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.duplicates
+}
+
+func readEvents(r *http.Request) ([]pdp.DecisionResult, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		body = gz
+	}
+
+	var events []pdp.DecisionResult
+	dec := json.NewDecoder(body)
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-ndjson") {
+		if err := dec.Decode(&events); err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
+
+	for dec.More() {
+		var event pdp.DecisionResult
+		if err := dec.Decode(&event); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, nil
+}
@@ -0,0 +1,437 @@
+package pdp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"log/slog"
+
+	"github.com/open-policy-agent/opa/ast"
+)
+
+// NewPolicyComposer creates a composer for the given git projects, see
+// NewSourceComposer.
+func NewPolicyComposer(projects []PolicyProject, eventHandler func(context.Context, string, []PolicyBundle) error) (*PolicyComposer, error) {
+	sources := make([]MountedSource, 0, len(projects))
+	for _, project := range projects {
+		sources = append(sources, MountedSource{
+			Source:       NewGitSource(project),
+			Mount:        project.Mount,
+			PollInterval: project.PollInterval,
+			PollJitter:   project.PollJitter,
+		})
+	}
+
+	return NewSourceComposer(sources, eventHandler)
+}
+
+// NewSourceComposer creates a composer for the given sources. Every source
+// is updated on its own, and whenever one of them changes the policies of
+// all sources are merged and passed to the event handler as one set. Module
+// names are prefixed with the source name, so equally named files in two
+// sources don't collide. The event handler is passed the composite revision
+// along with the policies.
+func NewSourceComposer(sources []MountedSource, eventHandler func(context.Context, string, []PolicyBundle) error) (*PolicyComposer, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no policy sources configured")
+	}
+
+	c := &PolicyComposer{
+		eventHandlerFunc: eventHandler,
+		stop:             make(chan struct{}),
+	}
+	names := make(map[string]struct{}, len(sources))
+	for _, ms := range sources {
+		name := ms.Source.Name()
+		if _, ok := names[name]; ok {
+			return nil, fmt.Errorf("duplicate policy source: %s", name)
+		}
+		names[name] = struct{}{}
+
+		mount, err := parseMount(ms.Mount)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mount of policy source %s: %w", name, err)
+		}
+
+		for _, other := range c.sources {
+			if len(mount) > 0 && len(other.mount) > 0 && (hasPackagePrefix(mount, other.mount) || hasPackagePrefix(other.mount, mount)) {
+				return nil, fmt.Errorf("policy sources %s and %s have overlapping mounts", other.name, name)
+			}
+		}
+
+		source := &composedSource{name: name, mount: mount}
+		source.updater = newSourceUpdater(ms.Source, ms.PollInterval, ms.PollJitter, func(ctx context.Context, revision *PolicyRevision, b []PolicyBundle) error {
+			return c.update(ctx, source, revision, b)
+		})
+		c.sources = append(c.sources, source)
+	}
+
+	return c, nil
+}
+
+// Subscribe adds a function that is called with every composition event,
+// after the event handler.
+func (c *PolicyComposer) Subscribe(subscriber func(context.Context, PolicyUpdateEvent)) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.subscribers = append(c.subscribers, subscriber)
+}
+
+// Start polls all sources for updates until the context is cancelled or Stop
+// is called.
+func (c *PolicyComposer) Start(ctx context.Context) {
+	for _, s := range c.sources {
+		go s.updater.Start(ctx)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-c.stop:
+	}
+}
+
+// Stop stops all sources, and waits for running updates to finish.
+func (c *PolicyComposer) Stop() {
+	for _, s := range c.sources {
+		s.updater.Stop()
+	}
+
+	c.stopOnce.Do(func() {
+		close(c.stop)
+	})
+}
+
+// RunUpdate updates all sources, and activates the merged policies once
+// every source has been loaded.
+func (c *PolicyComposer) RunUpdate(ctx context.Context) error {
+	c.hold()
+
+	var err error
+	for _, s := range c.sources {
+		err = errors.Join(err, s.updater.RunUpdate(ctx))
+	}
+
+	return errors.Join(err, c.release(ctx))
+}
+
+// LoadCached activates the cached revisions of all sources, see
+// PolicyUpdater.LoadCached. It only activates anything if every source has
+// a cached revision.
+func (c *PolicyComposer) LoadCached(ctx context.Context) (bool, error) {
+	c.hold()
+
+	var err error
+	for _, s := range c.sources {
+		_, loadErr := s.updater.LoadCached(ctx)
+		err = errors.Join(err, loadErr)
+	}
+
+	err = errors.Join(err, c.release(ctx))
+	return c.Revision() != "", err
+}
+
+// Trigger makes every source check for updates now.
+func (c *PolicyComposer) Trigger() {
+	for _, s := range c.sources {
+		s.updater.Trigger()
+	}
+}
+
+// TriggerRef triggers an update of the sources the ref can change, see
+// PolicyUpdater.TriggerRef.
+func (c *PolicyComposer) TriggerRef(ref string) bool {
+	triggered := false
+	for _, s := range c.sources {
+		triggered = s.updater.TriggerRef(ref) || triggered
+	}
+
+	return triggered
+}
+
+// Revision identifies the active combination of source revisions, it is
+// empty until every source has been loaded.
+func (c *PolicyComposer) Revision() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	return c.revision
+}
+
+// Status reports the active composite revision, and the status of every
+// source.
+func (c *PolicyComposer) Status() PolicyComposerStatus {
+	c.mtx.Lock()
+	status := PolicyComposerStatus{
+		Revision:  c.revision,
+		LastError: c.lastError,
+		Sources:   make([]PolicyUpdaterStatus, 0, len(c.sources)),
+	}
+	c.mtx.Unlock()
+
+	for _, s := range c.sources {
+		status.Sources = append(status.Sources, s.updater.Status())
+	}
+
+	return status
+}
+
+// SourceRevisions returns the active revision of every source, by name.
+func (c *PolicyComposer) SourceRevisions() map[string]string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	revisions := make(map[string]string, len(c.sources))
+	for _, s := range c.sources {
+		revisions[s.name] = s.activated.Hash
+	}
+
+	return revisions
+}
+
+// SignatureStatus reports the signature status of every source, by name.
+func (c *PolicyComposer) SignatureStatus() map[string]SignatureStatus {
+	status := make(map[string]SignatureStatus, len(c.sources))
+	for _, s := range c.sources {
+		status[s.name] = s.updater.SignatureStatus()
+	}
+
+	return status
+}
+
+// hold postpones activation until release, so updating several sources in
+// a row activates them together.
+func (c *PolicyComposer) hold() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.holding = true
+}
+
+// release activates the revisions the sources were updated to while held.
+// The source updaters already accepted them, so if they fail to compose the
+// updaters are rolled back to the active composition, and retry the update.
+func (c *PolicyComposer) release(ctx context.Context) error {
+	c.mtx.Lock()
+	c.holding = false
+	event, err := c.activate(ctx)
+	if err != nil {
+		for _, s := range c.sources {
+			c.restore(s)
+			if s.updater.activeRevision().Hash != s.activated.Hash {
+				slog.Warn("rolling back policy source after failed composition", slog.String("source", s.name), slog.String("hash", s.activated.Hash))
+				s.updater.rollback(s.activated, s.activatedBundles)
+			}
+		}
+	}
+	subscribers := c.subscribers
+	c.mtx.Unlock()
+
+	if event != nil {
+		publishEvent(ctx, subscribers, *event)
+	}
+
+	return err
+}
+
+func (c *PolicyComposer) update(ctx context.Context, source *composedSource, revision *PolicyRevision, bundles []PolicyBundle) error {
+	c.mtx.Lock()
+	source.revision = *revision
+	source.bundles = bundles
+	source.loaded = true
+	if c.holding {
+		c.mtx.Unlock()
+		return nil
+	}
+
+	event, err := c.activate(ctx)
+	if err != nil {
+		slog.Error("failed to compose policies", slog.String("source", source.name), slog.String("error", err.Error()))
+		c.restore(source)
+	}
+	subscribers := c.subscribers
+	c.mtx.Unlock()
+
+	if event != nil {
+		publishEvent(ctx, subscribers, *event)
+	}
+
+	return err
+}
+
+// restore resets the source to the revision in the active composition, after
+// a newer one failed to compose, so it doesn't block updates of the other
+// sources. The updater retries the newer revision with its next update. The
+// mutex must be held.
+func (c *PolicyComposer) restore(source *composedSource) {
+	source.revision = source.activated
+	source.bundles = source.activatedBundles
+	source.loaded = c.revision != ""
+}
+
+// activate merges the policies of all sources and passes them to the event
+// handler, if every source is loaded and the combination of revisions
+// changed. It returns the event subscribers are notified of, which the
+// caller publishes once the mutex is released, so subscribers can query the
+// composer. The mutex must be held.
+func (c *PolicyComposer) activate(ctx context.Context) (*PolicyUpdateEvent, error) {
+	for _, s := range c.sources {
+		if !s.loaded {
+			return nil, nil
+		}
+	}
+
+	hashes := make([]string, len(c.sources))
+	bundles := make([][]PolicyBundle, len(c.sources))
+	for i, s := range c.sources {
+		hashes[i], bundles[i] = s.revision.Hash, s.bundles
+	}
+
+	revision := c.compositeRevision(hashes)
+	if revision == c.revision {
+		return nil, nil
+	}
+
+	event := PolicyUpdateEvent{
+		Timestamp:   time.Now().UTC(),
+		OldRevision: c.revision,
+		NewRevision: revision,
+	}
+	for _, s := range c.sources {
+		if s.activated.Hash != s.revision.Hash {
+			event.Sources = append(event.Sources, PolicySourceChange{Source: s.name, OldRevision: s.activated, NewRevision: s.revision})
+		}
+	}
+
+	merged, err := c.merge(bundles)
+	if err == nil {
+		event.Added, event.Modified, event.Removed = diffBundles(c.bundles, merged)
+		slog.Info("policy composition", slog.String("revision", revision), slog.Int("modules", len(merged)))
+		err = c.eventHandlerFunc(ctx, revision, merged)
+	}
+
+	if err != nil {
+		c.lastError = err.Error()
+		event.Error = err.Error()
+		return &event, err
+	}
+
+	c.lastError = ""
+	c.revision = revision
+	c.bundles = merged
+	for _, s := range c.sources {
+		s.activated = s.revision
+		s.activatedBundles = s.bundles
+	}
+
+	return &event, nil
+}
+
+// merge combines the policies of all sources, given in the order of the
+// sources, and checks every package is owned by a single source. A package
+// belongs to the source whose mount it is under, and a package outside any
+// mount to the first source that defines it.
+func (c *PolicyComposer) merge(bundles [][]PolicyBundle) ([]PolicyBundle, error) {
+	owners := make(map[string]string)
+
+	var merged []PolicyBundle
+	for i, s := range c.sources {
+		for _, b := range bundles[i] {
+			module, err := ast.ParseModule(b.Name, string(b.Data))
+			if err != nil {
+				return nil, fmt.Errorf("policy source %s: %w", s.name, err)
+			}
+
+			pkg := packagePath(module)
+			name := strings.Join(pkg, ".")
+			if !hasPackagePrefix(pkg, s.mount) {
+				return nil, fmt.Errorf("policy source %s: package %s of %s is outside its mount %s", s.name, name, b.Name, strings.Join(s.mount, "."))
+			}
+
+			for _, other := range c.sources {
+				if other != s && len(other.mount) > 0 && hasPackagePrefix(pkg, other.mount) {
+					return nil, fmt.Errorf("policy source %s: package %s of %s is owned by %s", s.name, name, b.Name, other.name)
+				}
+			}
+
+			if owner, ok := owners[name]; ok && owner != s.name {
+				return nil, fmt.Errorf("policy source %s: package %s of %s is owned by %s", s.name, name, b.Name, owner)
+			}
+			owners[name] = s.name
+
+			merged = append(merged, PolicyBundle{
+				Name: path.Join(s.name, b.Name),
+				Data: b.Data,
+			})
+		}
+	}
+
+	return merged, nil
+}
+
+// compositeRevision hashes the name and revision of every source, given in
+// the order of the sources.
+func (c *PolicyComposer) compositeRevision(hashes []string) string {
+	revisions := make([]string, 0, len(c.sources))
+	for i, s := range c.sources {
+		revisions = append(revisions, s.name+"="+hashes[i])
+	}
+	sort.Strings(revisions)
+
+	sum := sha256.Sum256([]byte(strings.Join(revisions, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseMount splits a package prefix like platform.lib, or data.platform.lib,
+// into its parts.
+func parseMount(mount string) ([]string, error) {
+	mount = strings.TrimPrefix(strings.Trim(mount, "."), "data.")
+	if mount == "" || mount == "data" {
+		return nil, nil
+	}
+
+	parts := strings.Split(mount, ".")
+	for _, p := range parts {
+		if p == "" || strings.ContainsAny(p, " /[]\"") {
+			return nil, fmt.Errorf("invalid package prefix: %s", mount)
+		}
+	}
+
+	return parts, nil
+}
+
+// packagePath returns the parts of the package of a module, without the
+// leading data.
+func packagePath(module *ast.Module) []string {
+	var parts []string
+	for _, term := range module.Package.Path[1:] {
+		if s, ok := term.Value.(ast.String); ok {
+			parts = append(parts, string(s))
+		} else {
+			parts = append(parts, term.String())
+		}
+	}
+
+	return parts
+}
+
+func hasPackagePrefix(pkg []string, prefix []string) bool {
+	if len(prefix) > len(pkg) {
+		return false
+	}
+
+	for i := range prefix {
+		if pkg[i] != prefix[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,170 @@
+package pdp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memorySource provides a single module, whose revision is the hash of its
+// content.
+type memorySource struct {
+	name string
+	mtx  sync.Mutex
+	data string
+}
+
+func (s *memorySource) push(data string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.data = data
+}
+
+func (s *memorySource) Name() string {
+	return s.name
+}
+
+func (s *memorySource) Revision(ctx context.Context) (*PolicyRevision, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	sum := sha256.Sum256([]byte(s.data))
+	return &PolicyRevision{Ref: "memory", Hash: hex.EncodeToString(sum[:])}, nil
+}
+
+func (s *memorySource) Load(ctx context.Context, revision *PolicyRevision) ([]PolicyBundle, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return []PolicyBundle{{Name: s.name + ".rego", Data: []byte(s.data)}}, nil
+}
+
+// newTestComposer creates a composer of the sources, activating into a client
+// whose decisions show the active policies.
+func newTestComposer(t *testing.T, sources ...PolicySource) (*PolicyComposer, *PermitClient) {
+	t.Helper()
+
+	permit, err := New(&PermitConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mounted := make([]MountedSource, 0, len(sources))
+	for _, s := range sources {
+		mounted = append(mounted, MountedSource{Source: s})
+	}
+
+	composer, err := NewSourceComposer(mounted, func(ctx context.Context, revision string, b []PolicyBundle) error {
+		return permit.ActivateEnvironment(ctx, DefaultEnvironment, revision, b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return composer, permit
+}
+
+func expectDecision(t *testing.T, permit *PermitClient, path string, expected string) {
+	t.Helper()
+
+	result, err := permit.Decision(context.Background(), DecisionOptions{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.Result != expected {
+		t.Fatalf("expected %s to be %q, got %v", path, expected, result.Result)
+	}
+}
+
+func TestComposerRefusedRevisionDoesNotBlockOtherSources(t *testing.T) {
+	ctx := context.Background()
+	a := &memorySource{name: "a", data: "package a\n\nversion := \"1\"\n"}
+	b := &memorySource{name: "b", data: "package b\n\nversion := \"1\"\n"}
+	composer, permit := newTestComposer(t, a, b)
+
+	if err := composer.RunUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a.push("package a\n\nversion := \n")
+	if err := composer.sources[0].updater.RunUpdate(ctx); err == nil {
+		t.Fatal("expected the revision that doesn't compile to be refused")
+	}
+
+	b.push("package b\n\nversion := \"2\"\n")
+	if err := composer.sources[1].updater.RunUpdate(ctx); err != nil {
+		t.Fatalf("expected the update of the other source to activate, got %v", err)
+	}
+
+	expectDecision(t, permit, "a/version", "1")
+	expectDecision(t, permit, "b/version", "2")
+
+	// the refused source is retried, and activates once it's fixed
+	a.push("package a\n\nversion := \"2\"\n")
+	if err := composer.sources[0].updater.RunUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	expectDecision(t, permit, "a/version", "2")
+	if revisions := composer.SourceRevisions(); revisions["a"] != composer.sources[0].updater.activeRevision().Hash {
+		t.Fatalf("expected the fixed revision of a to be active, got %v", revisions)
+	}
+}
+
+func TestComposerRefusedHeldRevisionDoesNotBlockOtherSources(t *testing.T) {
+	ctx := context.Background()
+	a := &memorySource{name: "a", data: "package a\n\nversion := \"1\"\n"}
+	b := &memorySource{name: "b", data: "package b\n\nversion := \"1\"\n"}
+	composer, permit := newTestComposer(t, a, b)
+
+	if err := composer.RunUpdate(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	a.push("package a\n\nversion := \n")
+	if err := composer.RunUpdate(ctx); err == nil {
+		t.Fatal("expected the revision that doesn't compile to be refused")
+	}
+
+	b.push("package b\n\nversion := \"2\"\n")
+	if err := composer.sources[1].updater.RunUpdate(ctx); err != nil {
+		t.Fatalf("expected the update of the other source to activate, got %v", err)
+	}
+
+	expectDecision(t, permit, "a/version", "1")
+	expectDecision(t, permit, "b/version", "2")
+}
+
+func TestComposerSubscriberCanQueryComposer(t *testing.T) {
+	ctx := context.Background()
+	a := &memorySource{name: "a", data: "package a\n\nversion := \"1\"\n"}
+	composer, _ := newTestComposer(t, a)
+
+	var revisions []string
+	composer.Subscribe(func(ctx context.Context, event PolicyUpdateEvent) {
+		revisions = append(revisions, composer.Revision(), composer.Status().Revision)
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- composer.RunUpdate(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber querying the composer deadlocked")
+	}
+
+	if len(revisions) != 2 || revisions[0] == "" || revisions[0] != revisions[1] {
+		t.Fatalf("expected the subscriber to see the new revision, got %v", revisions)
+	}
+}
@@ -0,0 +1,213 @@
+package pdp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/gobwas/glob"
+)
+
+const policyIgnoreFile = ".pdpignore"
+
+// policyFilter selects the policy files to load below a root directory. Paths
+// are matched relative to the root, using '/' as separator.
+type policyFilter struct {
+	include []glob.Glob
+	exclude []glob.Glob
+	ignore  gitignore.Matcher
+}
+
+func newPolicyFilter(fs billy.Filesystem, root string, include []string, exclude []string) (*policyFilter, error) {
+	var err error
+	filter := &policyFilter{}
+
+	filter.include, err = compileGlobs(include)
+	if err != nil {
+		return nil, fmt.Errorf("invalid include pattern: %w", err)
+	}
+
+	filter.exclude, err = compileGlobs(exclude)
+	if err != nil {
+		return nil, fmt.Errorf("invalid exclude pattern: %w", err)
+	}
+
+	patterns, err := readIgnoreFile(fs, path.Join(root, policyIgnoreFile))
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to read "+policyIgnoreFile))
+	}
+
+	filter.ignore = gitignore.NewMatcher(patterns)
+	return filter, nil
+}
+
+// skipDir reports whether nothing below the directory can be loaded.
+func (f *policyFilter) skipDir(rel string) bool {
+	return f.ignore.Match(strings.Split(rel, "/"), true) || matchAny(f.exclude, rel)
+}
+
+func (f *policyFilter) matchFile(rel string) bool {
+	if !strings.HasSuffix(rel, ".rego") {
+		return false
+	}
+
+	if f.ignore.Match(strings.Split(rel, "/"), false) || matchAny(f.exclude, rel) {
+		return false
+	}
+
+	return len(f.include) == 0 || matchAny(f.include, rel)
+}
+
+// discoverBundles loads the policy files below root that pass the include and
+// exclude globs and the ignore file. Modules are named after their path
+// relative to root, without the .rego extension.
+func discoverBundles(fs billy.Filesystem, root string, include []string, exclude []string) ([]PolicyBundle, error) {
+	root = strings.Trim(filepath.ToSlash(root), "/")
+
+	filter, err := newPolicyFilter(fs, root, include, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	var bundles []PolicyBundle
+	err = util.Walk(fs, root, func(fileName string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if fileName == root {
+				return fmt.Errorf("policy root %q: %w", root, err)
+			}
+			return nil
+		}
+
+		rel := relativePath(root, fileName)
+
+		// ConfigMap volumes keep the files in hidden ..data directories, and
+		// link them into the root
+		if rel != "" && strings.HasPrefix(fi.Name(), "..") {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if fi.IsDir() {
+			// an on-disk cache keeps the repository next to the worktree
+			if fi.Name() == git.GitDirName {
+				return filepath.SkipDir
+			}
+
+			if rel != "" && filter.skipDir(rel) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		// follow links to files, but not to directories as they could loop
+		if fi.Mode()&os.ModeSymlink != 0 {
+			fi, err = fs.Stat(fileName)
+			if err != nil {
+				return nil
+			}
+		}
+
+		// handle policy files only
+		if !fi.Mode().IsRegular() || !filter.matchFile(rel) {
+			return nil
+		}
+
+		data, err := readFile(fs, fileName)
+		if err != nil {
+			return errors.Join(err, errors.New("failed to read policy"))
+		}
+
+		bundles = append(bundles, PolicyBundle{
+			Name: strings.TrimSuffix(rel, ".rego"),
+			Data: data,
+		})
+		return nil
+	})
+
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to walk fs"))
+	}
+
+	return bundles, nil
+}
+
+func relativePath(root string, fileName string) string {
+	rel := strings.TrimPrefix(filepath.ToSlash(fileName), "/")
+	if root == "" {
+		return rel
+	}
+
+	if rel == root {
+		return ""
+	}
+
+	return strings.TrimPrefix(rel, root+"/")
+}
+
+func readIgnoreFile(fs billy.Filesystem, name string) ([]gitignore.Pattern, error) {
+	file, err := fs.Open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []gitignore.Pattern
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		patterns = append(patterns, gitignore.ParsePattern(line, nil))
+	}
+
+	return patterns, scanner.Err()
+}
+
+func readFile(fs billy.Filesystem, name string) ([]byte, error) {
+	file, err := fs.Open(name)
+	if err != nil {
+		return nil, errors.Join(err, errors.New("failed to open file"))
+	}
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+func compileGlobs(patterns []string) ([]glob.Glob, error) {
+	var globs []glob.Glob
+	for _, pattern := range patterns {
+		g, err := glob.Compile(strings.Trim(pattern, "/"), '/')
+		if err != nil {
+			return nil, err
+		}
+
+		globs = append(globs, g)
+	}
+
+	return globs, nil
+}
+
+func matchAny(globs []glob.Glob, rel string) bool {
+	for _, g := range globs {
+		if g.Match(rel) {
+			return true
+		}
+	}
+
+	return false
+}
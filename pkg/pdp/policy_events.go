@@ -0,0 +1,53 @@
+package pdp
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+)
+
+// diffBundles compares the modules of two activations by name and content
+// hash. The changes are sorted by name.
+func diffBundles(old []PolicyBundle, new []PolicyBundle) (added []PolicyModuleChange, modified []PolicyModuleChange, removed []PolicyModuleChange) {
+	oldHashes := make(map[string]string, len(old))
+	for _, b := range old {
+		oldHashes[b.Name] = contentHash(b.Data)
+	}
+
+	for _, b := range new {
+		hash := contentHash(b.Data)
+		oldHash, ok := oldHashes[b.Name]
+		delete(oldHashes, b.Name)
+
+		switch {
+		case !ok:
+			added = append(added, PolicyModuleChange{Name: b.Name, NewHash: hash})
+		case oldHash != hash:
+			modified = append(modified, PolicyModuleChange{Name: b.Name, OldHash: oldHash, NewHash: hash})
+		}
+	}
+
+	for name, hash := range oldHashes {
+		removed = append(removed, PolicyModuleChange{Name: name, OldHash: hash})
+	}
+
+	for _, changes := range [][]PolicyModuleChange{added, modified, removed} {
+		sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	}
+
+	return added, modified, removed
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// publishEvent passes the event to every subscriber in order. Subscribers are
+// called on the update goroutine, so they should hand off slow work.
+func publishEvent(ctx context.Context, subscribers []func(context.Context, PolicyUpdateEvent), event PolicyUpdateEvent) {
+	for _, subscriber := range subscribers {
+		subscriber(ctx, event)
+	}
+}
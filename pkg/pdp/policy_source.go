@@ -0,0 +1,52 @@
+package pdp
+
+import (
+	"context"
+	"time"
+)
+
+// PolicySource provides the policies a PolicyUpdater activates, e.g. a git
+// repository or a local directory.
+type PolicySource interface {
+	// Name identifies the source in logs and status.
+	Name() string
+	// Revision resolves the revision the source provides now.
+	Revision(ctx context.Context) (*PolicyRevision, error)
+	// Load loads the policies of a revision returned by Revision. If the
+	// source changed in the meantime, the hash is updated to what was loaded.
+	Load(ctx context.Context, revision *PolicyRevision) ([]PolicyBundle, error)
+}
+
+// PolicyWatcher is implemented by sources that notice changes themselves.
+// Watch calls notify when the source changed, until the context is
+// cancelled. The updater keeps polling as well.
+type PolicyWatcher interface {
+	Watch(ctx context.Context, notify func()) error
+}
+
+// cachedSource is implemented by sources that keep the last activated
+// revision, so it can be activated on startup without contacting the remote.
+// Saving an empty revision clears it.
+type cachedSource interface {
+	loadCached(ctx context.Context) (*PolicyRevision, []PolicyBundle, error)
+	saveCached(revision *PolicyRevision)
+}
+
+// refSource is implemented by sources that follow git refs, so push
+// notifications can trigger an update.
+type refSource interface {
+	matchesRef(ref string) bool
+}
+
+// signedSource is implemented by sources that verify signatures.
+type signedSource interface {
+	SignatureStatus() SignatureStatus
+}
+
+// historySource is implemented by sources that can load past revisions, by
+// commit or as they were at a point in time. Resolving a revision is cheap,
+// so cached policies of the revision can be used before loading them.
+type historySource interface {
+	resolveHistorical(ctx context.Context, commit string, at time.Time) (*PolicyRevision, error)
+	loadHistorical(ctx context.Context, revision *PolicyRevision) ([]PolicyBundle, error)
+}
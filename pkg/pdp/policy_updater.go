@@ -0,0 +1,429 @@
+package pdp
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"log/slog"
+)
+
+const (
+	defaultPollInterval = time.Minute
+	minUpdateBackoff    = 5 * time.Second
+	maxUpdateBackoff    = 10 * time.Minute
+)
+
+// NewPolicyUpdater creates an updater for a repository accessed with a ssh key,
+// or anonymously if the key is empty.
+func NewPolicyUpdater(repository string, repositoryKey string, repositoryBranch string, eventHandler func(context.Context, []PolicyBundle)) *PolicyUpdater {
+	return NewProjectUpdater(PolicyProject{
+		Url:    repository,
+		Branch: repositoryBranch,
+		Auth:   PolicyAuth{SSHKey: []byte(repositoryKey)},
+	}, eventHandler)
+}
+
+// NewProjectUpdater creates an updater for the given project.
+func NewProjectUpdater(project PolicyProject, eventHandler func(context.Context, []PolicyBundle)) *PolicyUpdater {
+	return NewSourceUpdater(NewGitSource(project), project.PollInterval, project.PollJitter, func(ctx context.Context, b []PolicyBundle) error {
+		eventHandler(ctx, b)
+		return nil
+	})
+}
+
+// NewSourceUpdater creates an updater for the given source, polling it for
+// updates every interval, randomized by up to the jitter fraction. The event
+// handler activates the policies of a new revision, and if it fails the
+// revision is tried again on the next update.
+func NewSourceUpdater(source PolicySource, pollInterval time.Duration, pollJitter float64, eventHandler func(context.Context, []PolicyBundle) error) *PolicyUpdater {
+	return newSourceUpdater(source, pollInterval, pollJitter, func(ctx context.Context, _ *PolicyRevision, b []PolicyBundle) error {
+		return eventHandler(ctx, b)
+	})
+}
+
+func newSourceUpdater(source PolicySource, pollInterval time.Duration, pollJitter float64, activate func(context.Context, *PolicyRevision, []PolicyBundle) error) *PolicyUpdater {
+	if pollInterval <= 0 {
+		pollInterval = defaultPollInterval
+	}
+
+	if pollJitter < 0 {
+		pollJitter = 0
+	}
+
+	return &PolicyUpdater{
+		source:       source,
+		pollInterval: pollInterval,
+		pollJitter:   pollJitter,
+		activateFunc: activate,
+		trigger:      make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+	}
+}
+
+// Subscribe adds a function that is called with every update event, after
+// the event handler.
+func (b *PolicyUpdater) Subscribe(subscriber func(context.Context, PolicyUpdateEvent)) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.subscribers = append(b.subscribers, subscriber)
+}
+
+// Name returns the name of the source.
+func (b *PolicyUpdater) Name() string {
+	return b.source.Name()
+}
+
+// Start polls the source for updates until the context is cancelled or Stop
+// is called. An update can be run early with Trigger, which sources that
+// watch for changes do themselves. Failed updates are retried with an
+// exponential backoff. It returns right away if the updater is already
+// running, or was stopped.
+func (b *PolicyUpdater) Start(ctx context.Context) {
+	b.mtx.Lock()
+	select {
+	case <-b.stop:
+		b.mtx.Unlock()
+		return
+	default:
+	}
+
+	if b.done != nil {
+		b.mtx.Unlock()
+		return
+	}
+
+	done := make(chan struct{})
+	b.done = done
+	b.mtx.Unlock()
+	defer close(done)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if w, ok := b.source.(PolicyWatcher); ok {
+		go func() {
+			err := w.Watch(ctx, b.Trigger)
+			if err != nil {
+				slog.Error("failed to watch policy source, falling back to polling", slog.String("source", b.Name()), slog.String("error", err.Error()))
+			}
+		}()
+	}
+
+	timer := time.NewTimer(b.nextDelay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.stop:
+			return
+		case <-timer.C:
+		case <-b.trigger:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		}
+
+		err := b.RunUpdate(ctx)
+		if err != nil {
+			slog.Debug("policy update failed, retrying after backoff", slog.String("source", b.Name()), slog.Float64("backoff_seconds", b.Status().CurrentBackoffSeconds))
+		}
+
+		timer.Reset(b.nextDelay())
+	}
+}
+
+// Stop stops Start, and waits for a running update to finish. The stop
+// channel is closed under the mutex, so a Start racing with it either sees
+// the updater stopped, or is waited for.
+func (b *PolicyUpdater) Stop() {
+	b.mtx.Lock()
+	b.stopOnce.Do(func() {
+		close(b.stop)
+	})
+	done := b.done
+	b.mtx.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// Trigger makes Start run an update now, instead of waiting for the next
+// poll. Triggers received while an update is pending are coalesced.
+func (b *PolicyUpdater) Trigger() {
+	select {
+	case b.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// TriggerRef triggers an update if the ref (e.g. refs/heads/main) can change
+// the revision the updater follows, and reports whether it did. Any tag can
+// when following tags, nothing can when a commit is pinned or the source
+// isn't a git repository.
+func (b *PolicyUpdater) TriggerRef(ref string) bool {
+	s, ok := b.source.(refSource)
+	if !ok || !s.matchesRef(ref) {
+		return false
+	}
+
+	b.Trigger()
+	return true
+}
+
+// nextDelay returns the poll interval, or the backoff after a failed update,
+// randomized by the jitter so a fleet of PDPs started together doesn't poll
+// the git server in lockstep.
+func (b *PolicyUpdater) nextDelay() time.Duration {
+	b.mtx.Lock()
+	delay := b.currentBackoff
+	b.mtx.Unlock()
+
+	if delay == 0 {
+		delay = b.pollInterval
+	}
+
+	return time.Duration(float64(delay) * (1 + b.pollJitter*(rand.Float64()*2-1)))
+}
+
+// recordAttempt updates the status after an update check, and doubles the
+// backoff for every consecutive failure.
+func (b *PolicyUpdater) recordAttempt(err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	b.lastAttempt = time.Now().UTC()
+	if err == nil {
+		b.lastSuccess = b.lastAttempt
+		b.lastError = ""
+		b.consecutiveFailures = 0
+		b.currentBackoff = 0
+		return
+	}
+
+	b.lastError = err.Error()
+	b.consecutiveFailures++
+	if b.currentBackoff == 0 {
+		b.currentBackoff = minUpdateBackoff
+	} else {
+		b.currentBackoff *= 2
+	}
+
+	if b.currentBackoff > maxUpdateBackoff {
+		b.currentBackoff = maxUpdateBackoff
+	}
+}
+
+// RunUpdate checks the source for updates, and activates the new revision if
+// there is one. Concurrent updates are run one after another.
+func (b *PolicyUpdater) RunUpdate(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	b.updateMtx.Lock()
+	defer b.updateMtx.Unlock()
+
+	err := b.runUpdate(ctx)
+	b.recordAttempt(err)
+	return err
+}
+
+func (b *PolicyUpdater) runUpdate(ctx context.Context) error {
+	update, err := b.checkForUpdates(ctx)
+	if err != nil {
+		slog.Error("failed to check for policy updates", slog.String("error", err.Error()), slog.String("source", b.Name()))
+		return err
+	}
+
+	slog.Debug(
+		"Checking for policy updates",
+		slog.String("source", b.Name()),
+		slog.String("ref", update.Ref),
+		slog.Bool("update_avaliable", update.Available),
+		slog.String("new_hash", update.NewHash),
+		slog.String("old_hash", update.OldHash),
+	)
+
+	if update.Available {
+		bundles, err := b.source.Load(ctx, update.revision)
+		if err != nil {
+			slog.Error("failed to create policy bundles", slog.String("error", err.Error()), slog.String("source", b.Name()))
+			return err
+		}
+
+		slog.Info("policy update", slog.String("source", b.Name()), slog.String("ref", update.revision.Ref), slog.String("hash", update.revision.Hash))
+		err = b.activate(ctx, update.revision, bundles)
+		if err != nil {
+			slog.Error("failed to activate policy update", slog.String("error", err.Error()), slog.String("source", b.Name()))
+			return err
+		}
+
+		if s, ok := b.source.(cachedSource); ok {
+			s.saveCached(update.revision)
+		}
+	}
+
+	return nil
+}
+
+// LoadCached activates the revision that was last activated, if the source
+// keeps it, without contacting the remote. This lets the PDP become ready
+// while the git server is unavailable. It does nothing if the source has no
+// cache or nothing was activated yet.
+func (b *PolicyUpdater) LoadCached(ctx context.Context) (bool, error) {
+	s, ok := b.source.(cachedSource)
+	if !ok {
+		return false, nil
+	}
+
+	b.updateMtx.Lock()
+	defer b.updateMtx.Unlock()
+
+	revision, bundles, err := s.loadCached(ctx)
+	if err != nil || revision == nil {
+		return false, err
+	}
+
+	slog.Info("policy update from cache", slog.String("source", b.Name()), slog.String("ref", revision.Ref), slog.String("hash", revision.Hash))
+	err = b.activate(ctx, revision, bundles)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// activate passes the policies to the event handler, and makes the revision
+// the active one if the handler succeeded. Subscribers are notified either
+// way.
+func (b *PolicyUpdater) activate(ctx context.Context, revision *PolicyRevision, bundles []PolicyBundle) error {
+	b.mtx.Lock()
+	old, oldBundles := b.revision, b.bundles
+	b.mtx.Unlock()
+
+	err := b.activateFunc(ctx, revision, bundles)
+
+	event := PolicyUpdateEvent{
+		Timestamp:   time.Now().UTC(),
+		OldRevision: old.Hash,
+		NewRevision: revision.Hash,
+		Sources:     []PolicySourceChange{{Source: b.Name(), OldRevision: old, NewRevision: *revision}},
+	}
+	event.Added, event.Modified, event.Removed = diffBundles(oldBundles, bundles)
+
+	b.mtx.Lock()
+	if err != nil {
+		event.Error = err.Error()
+	} else {
+		b.revision = *revision
+		b.bundles = bundles
+	}
+	subscribers := b.subscribers
+	b.mtx.Unlock()
+
+	publishEvent(ctx, subscribers, event)
+	return err
+}
+
+// rollback makes the revision the active one again, after a newer one was
+// accepted by a composer but failed to compose later. The cache is reset to
+// the revision too, so the newer revision is retried by the next update.
+func (b *PolicyUpdater) rollback(revision PolicyRevision, bundles []PolicyBundle) {
+	b.mtx.Lock()
+	b.revision = revision
+	b.bundles = bundles
+	b.mtx.Unlock()
+
+	if s, ok := b.source.(cachedSource); ok {
+		s.saveCached(&revision)
+	}
+}
+
+// activeRevision returns the revision that was activated last.
+func (b *PolicyUpdater) activeRevision() PolicyRevision {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.revision
+}
+
+// GenerateBundles loads the policies of the revision the source provides now.
+func (b *PolicyUpdater) GenerateBundles() ([]PolicyBundle, error) {
+	ctx := context.Background()
+	revision, err := b.source.Revision(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.source.Load(ctx, revision)
+}
+
+func (b *PolicyUpdater) CheckForUpdates() (*PolicyProjectUpdate, error) {
+	return b.checkForUpdates(context.Background())
+}
+
+func (b *PolicyUpdater) checkForUpdates(ctx context.Context) (*PolicyProjectUpdate, error) {
+	active := b.activeRevision()
+	update := PolicyProjectUpdate{
+		Available: false,
+		OldHash:   active.Hash,
+		NewHash:   active.Hash,
+		Ref:       active.Ref,
+	}
+	revision, err := b.source.Revision(ctx)
+	if err != nil {
+		return &update, err
+	}
+
+	update.revision = revision
+	if active.Hash != revision.Hash {
+		update.NewHash = revision.Hash
+		update.Ref = revision.Ref
+		update.Available = true
+		return &update, nil
+	}
+
+	return &update, nil
+}
+
+// Status reports the active revision and modules, and the outcome of the
+// last updates.
+func (b *PolicyUpdater) Status() PolicyUpdaterStatus {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	modules := make([]string, 0, len(b.bundles))
+	for _, bundle := range b.bundles {
+		modules = append(modules, bundle.Name)
+	}
+
+	return PolicyUpdaterStatus{
+		Source:                b.source.Name(),
+		Ref:                   b.revision.Ref,
+		Hash:                  b.revision.Hash,
+		LastAttempt:           b.lastAttempt,
+		LastSuccess:           b.lastSuccess,
+		LastError:             b.lastError,
+		ConsecutiveFailures:   b.consecutiveFailures,
+		CurrentBackoffSeconds: b.currentBackoff.Seconds(),
+		Modules:               modules,
+	}
+}
+
+// SignatureStatus reports the outcome of the signature verification of the
+// revisions loaded so far, if the source verifies signatures.
+func (b *PolicyUpdater) SignatureStatus() SignatureStatus {
+	if s, ok := b.source.(signedSource); ok {
+		return s.SignatureStatus()
+	}
+
+	return SignatureStatus{}
+}
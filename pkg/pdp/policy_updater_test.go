@@ -0,0 +1,119 @@
+package pdp
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestUpdater creates an updater that polls rarely, and counts its
+// activations.
+func newTestUpdater() (*PolicyUpdater, *atomic.Int32) {
+	activations := &atomic.Int32{}
+	source := &memorySource{name: "a", data: "package a\n\nversion := \"1\"\n"}
+	updater := NewSourceUpdater(source, time.Hour, 0, func(ctx context.Context, b []PolicyBundle) error {
+		activations.Add(1)
+		return nil
+	})
+
+	return updater, activations
+}
+
+// returnsWithin fails the test if f doesn't return within a few seconds.
+func returnsWithin(t *testing.T, name string, f func()) {
+	t.Helper()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s didn't return", name)
+	}
+}
+
+func TestUpdaterStartStop(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		updater, _ := newTestUpdater()
+
+		var wg sync.WaitGroup
+		wg.Add(4)
+		go func() {
+			defer wg.Done()
+			updater.Start(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			updater.Start(context.Background())
+		}()
+		go func() {
+			defer wg.Done()
+			updater.Stop()
+		}()
+		go func() {
+			defer wg.Done()
+			updater.Stop()
+		}()
+
+		returnsWithin(t, "concurrent Start and Stop", wg.Wait)
+	}
+}
+
+func TestUpdaterNoUpdateAfterStop(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		updater, activations := newTestUpdater()
+		updater.Trigger()
+
+		returned := make(chan struct{})
+		go func() {
+			defer close(returned)
+			updater.Start(context.Background())
+		}()
+
+		updater.Stop()
+		stopped := activations.Load()
+		returnsWithin(t, "Start", func() { <-returned })
+
+		if got := activations.Load(); got != stopped {
+			t.Fatalf("expected no update after Stop returned, got %d more", got-stopped)
+		}
+	}
+}
+
+func TestUpdaterStopWaitsForStart(t *testing.T) {
+	updater, _ := newTestUpdater()
+
+	returned := make(chan struct{})
+	go func() {
+		defer close(returned)
+		updater.Start(context.Background())
+	}()
+
+	returnsWithin(t, "waiting for Start", func() {
+		for {
+			updater.mtx.Lock()
+			running := updater.done != nil
+			updater.mtx.Unlock()
+			if running {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	// the updater is already running
+	returnsWithin(t, "second Start", func() { updater.Start(context.Background()) })
+
+	returnsWithin(t, "Stop", updater.Stop)
+	returnsWithin(t, "Start", func() { <-returned })
+
+	// stopping again, or starting after the stop, returns right away
+	returnsWithin(t, "second Stop", updater.Stop)
+	returnsWithin(t, "Start after Stop", func() { updater.Start(context.Background()) })
+}
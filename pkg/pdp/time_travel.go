@@ -0,0 +1,242 @@
+package pdp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const defaultTimeTravelCacheSize = 8
+
+// TimeTravel evaluates decisions against the policies of a past revision,
+// e.g. to find out during an incident review whether a request would have
+// been allowed last week. The past policies are loaded into snapshots of their
+// own, so the active policies are never touched. The most recently used
+// snapshots are kept, so repeated decisions against the same revision don't
+// compile the policies again.
+type TimeTravel struct {
+	composer  *PolicyComposer
+	cacheSize int
+	mtx       sync.Mutex
+	snapshots map[string]*policySnapshot
+	order     []string // cached revisions, least recently used first
+}
+
+// historicalPolicies are the policies of every source at a past revision.
+// The bundles of sources with history are only loaded when the policies
+// aren't cached yet.
+type historicalPolicies struct {
+	revision  string
+	sources   map[string]PolicyRevision
+	revisions []*PolicyRevision // the revision of every source, in the order of the sources
+	bundles   [][]PolicyBundle  // the policies of every source, nil until loaded
+}
+
+// NewTimeTravel creates a TimeTravel for the sources of the composer, keeping
+// up to cacheSize snapshots.
+func NewTimeTravel(composer *PolicyComposer, cacheSize int) *TimeTravel {
+	if cacheSize <= 0 {
+		cacheSize = defaultTimeTravelCacheSize
+	}
+
+	return &TimeTravel{
+		composer:  composer,
+		cacheSize: cacheSize,
+		snapshots: make(map[string]*policySnapshot),
+	}
+}
+
+// Decision evaluates the decision against the policies of the historical
+// revision. Historical decisions aren't written to the decision log.
+func (t *TimeTravel) Decision(ctx context.Context, at HistoricalRevision, options DecisionOptions) (*HistoricalDecision, error) {
+	policies, err := t.composer.historical(ctx, at)
+	if err != nil {
+		return nil, err
+	}
+
+	snap, err := t.snapshot(ctx, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := newDecisionResult()
+	if err != nil {
+		return nil, err
+	}
+
+	err = snap.decision(ctx, options, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HistoricalDecision{
+		Revision: policies.revision,
+		Sources:  policies.sources,
+		Result:   *result,
+	}, nil
+}
+
+// snapshot returns the cached snapshot of the revision, or loads the policies
+// and compiles them into a new one. The lock isn't held while loading, so a
+// slow load doesn't hold up decisions against other revisions. Concurrent
+// misses of the same revision both load it, and the first one is kept.
+func (t *TimeTravel) snapshot(ctx context.Context, policies *historicalPolicies) (*policySnapshot, error) {
+	t.mtx.Lock()
+	snap, ok := t.snapshots[policies.revision]
+	if ok {
+		t.use(policies.revision)
+	}
+	t.mtx.Unlock()
+
+	if ok {
+		return snap, nil
+	}
+
+	bundles, err := t.composer.loadHistorical(ctx, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	snap = newPolicySnapshot()
+	if err := snap.activate(ctx, policies.revision, bundles); err != nil {
+		return nil, err
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	if cached, ok := t.snapshots[policies.revision]; ok {
+		snap = cached
+	} else {
+		t.snapshots[policies.revision] = snap
+	}
+	t.use(policies.revision)
+
+	return snap, nil
+}
+
+// use marks the revision as the most recently used, and evicts the least
+// recently used snapshot if the cache is full. The mutex must be held.
+func (t *TimeTravel) use(revision string) {
+	for i, r := range t.order {
+		if r == revision {
+			t.order = append(t.order[:i], t.order[i+1:]...)
+			break
+		}
+	}
+	t.order = append(t.order, revision)
+
+	if len(t.order) > t.cacheSize {
+		delete(t.snapshots, t.order[0])
+		t.order = t.order[1:]
+	}
+}
+
+// historical resolves the revision of every source at the historical
+// revision. Sources without history, like a local directory, take part with
+// their active policies.
+func (c *PolicyComposer) historical(ctx context.Context, at HistoricalRevision) (*historicalPolicies, error) {
+	if at.Commit == "" && at.Time.IsZero() {
+		return nil, errors.New("a commit or time is required")
+	}
+
+	target := -1
+	if at.Commit != "" {
+		for i, s := range c.sources {
+			if _, ok := s.updater.source.(historySource); !ok || (at.Source != "" && s.name != at.Source) {
+				continue
+			}
+
+			if target >= 0 {
+				return nil, fmt.Errorf("commit %s is ambiguous, name its source", at.Commit)
+			}
+			target = i
+		}
+
+		if target < 0 && at.Source != "" {
+			return nil, fmt.Errorf("policy source %s not found or has no history", at.Source)
+		} else if target < 0 {
+			return nil, errors.New("no policy source has history")
+		}
+	}
+
+	policies := &historicalPolicies{
+		sources:   make(map[string]PolicyRevision, len(c.sources)),
+		revisions: make([]*PolicyRevision, len(c.sources)),
+		bundles:   make([][]PolicyBundle, len(c.sources)),
+	}
+	when := at.Time
+	resolve := func(i int, commit string) error {
+		s := c.sources[i]
+		revision, err := s.updater.source.(historySource).resolveHistorical(ctx, commit, when)
+		if err != nil {
+			return fmt.Errorf("policy source %s: %w", s.name, err)
+		}
+
+		policies.revisions[i], policies.sources[s.name] = revision, *revision
+		if commit != "" && revision.Commit != nil {
+			when = revision.Commit.Time
+		}
+		return nil
+	}
+
+	if target >= 0 {
+		if err := resolve(target, at.Commit); err != nil {
+			return nil, err
+		}
+
+		if when.IsZero() {
+			return nil, fmt.Errorf("failed to read the time of commit %s", at.Commit)
+		}
+	}
+
+	for i, s := range c.sources {
+		if i == target {
+			continue
+		}
+
+		if _, ok := s.updater.source.(historySource); ok {
+			if err := resolve(i, ""); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		c.mtx.Lock()
+		loaded, revision, b := s.loaded, s.activated, s.activatedBundles
+		c.mtx.Unlock()
+		if !loaded {
+			return nil, fmt.Errorf("policy source %s not loaded", s.name)
+		}
+
+		policies.revisions[i], policies.bundles[i], policies.sources[s.name] = &revision, b, revision
+	}
+
+	hashes := make([]string, len(c.sources))
+	for i, revision := range policies.revisions {
+		hashes[i] = revision.Hash
+	}
+	policies.revision = c.compositeRevision(hashes)
+
+	return policies, nil
+}
+
+// loadHistorical loads the policies of the sources with history at their
+// resolved revisions, and merges the policies of all sources.
+func (c *PolicyComposer) loadHistorical(ctx context.Context, policies *historicalPolicies) ([]PolicyBundle, error) {
+	for i, s := range c.sources {
+		source, ok := s.updater.source.(historySource)
+		if !ok {
+			continue
+		}
+
+		b, err := source.loadHistorical(ctx, policies.revisions[i])
+		if err != nil {
+			return nil, fmt.Errorf("policy source %s: %w", s.name, err)
+		}
+		policies.bundles[i] = b
+	}
+
+	return c.merge(policies.bundles)
+}
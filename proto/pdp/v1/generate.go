@@ -0,0 +1,4 @@
+// Package pdpv1 holds the protobuf messages and gRPC service of the PDP.
+package pdpv1
+
+//go:generate protoc -I ../.. --go_out=../.. --go_opt=paths=source_relative --go-grpc_out=../.. --go-grpc_opt=paths=source_relative pdp/v1/pdp.proto
@@ -0,0 +1,264 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pdp/v1/pdp.proto
+
+package pdpv1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	DecisionService_Decide_FullMethodName          = "/pdp.v1.DecisionService/Decide"
+	DecisionService_DecideBatch_FullMethodName     = "/pdp.v1.DecisionService/DecideBatch"
+	DecisionService_GetPolicyStatus_FullMethodName = "/pdp.v1.DecisionService/GetPolicyStatus"
+	DecisionService_WatchRevisions_FullMethodName  = "/pdp.v1.DecisionService/WatchRevisions"
+)
+
+// DecisionServiceClient is the client API for DecisionService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DecisionServiceClient interface {
+	// Decide evaluates a single decision. An undefined decision fails with
+	// NOT_FOUND, an unknown environment with INVALID_ARGUMENT and a PDP without
+	// policies with UNAVAILABLE.
+	Decide(ctx context.Context, in *DecisionRequest, opts ...grpc.CallOption) (*DecisionResponse, error)
+	// DecideBatch evaluates several decisions, each failing on its own.
+	DecideBatch(ctx context.Context, in *BatchDecisionRequest, opts ...grpc.CallOption) (*BatchDecisionResponse, error)
+	// GetPolicyStatus reports the active revision and the status of every
+	// policy source.
+	GetPolicyStatus(ctx context.Context, in *PolicyStatusRequest, opts ...grpc.CallOption) (*PolicyStatusResponse, error)
+	// WatchRevisions streams an event for every policy update, starting with
+	// the active revision.
+	WatchRevisions(ctx context.Context, in *WatchRevisionsRequest, opts ...grpc.CallOption) (DecisionService_WatchRevisionsClient, error)
+}
+
+type decisionServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDecisionServiceClient(cc grpc.ClientConnInterface) DecisionServiceClient {
+	return &decisionServiceClient{cc}
+}
+
+func (c *decisionServiceClient) Decide(ctx context.Context, in *DecisionRequest, opts ...grpc.CallOption) (*DecisionResponse, error) {
+	out := new(DecisionResponse)
+	err := c.cc.Invoke(ctx, DecisionService_Decide_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *decisionServiceClient) DecideBatch(ctx context.Context, in *BatchDecisionRequest, opts ...grpc.CallOption) (*BatchDecisionResponse, error) {
+	out := new(BatchDecisionResponse)
+	err := c.cc.Invoke(ctx, DecisionService_DecideBatch_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *decisionServiceClient) GetPolicyStatus(ctx context.Context, in *PolicyStatusRequest, opts ...grpc.CallOption) (*PolicyStatusResponse, error) {
+	out := new(PolicyStatusResponse)
+	err := c.cc.Invoke(ctx, DecisionService_GetPolicyStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *decisionServiceClient) WatchRevisions(ctx context.Context, in *WatchRevisionsRequest, opts ...grpc.CallOption) (DecisionService_WatchRevisionsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DecisionService_ServiceDesc.Streams[0], DecisionService_WatchRevisions_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &decisionServiceWatchRevisionsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DecisionService_WatchRevisionsClient interface {
+	Recv() (*RevisionEvent, error)
+	grpc.ClientStream
+}
+
+type decisionServiceWatchRevisionsClient struct {
+	grpc.ClientStream
+}
+
+func (x *decisionServiceWatchRevisionsClient) Recv() (*RevisionEvent, error) {
+	m := new(RevisionEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DecisionServiceServer is the server API for DecisionService service.
+// All implementations must embed UnimplementedDecisionServiceServer
+// for forward compatibility
+type DecisionServiceServer interface {
+	// Decide evaluates a single decision. An undefined decision fails with
+	// NOT_FOUND, an unknown environment with INVALID_ARGUMENT and a PDP without
+	// policies with UNAVAILABLE.
+	Decide(context.Context, *DecisionRequest) (*DecisionResponse, error)
+	// DecideBatch evaluates several decisions, each failing on its own.
+	DecideBatch(context.Context, *BatchDecisionRequest) (*BatchDecisionResponse, error)
+	// GetPolicyStatus reports the active revision and the status of every
+	// policy source.
+	GetPolicyStatus(context.Context, *PolicyStatusRequest) (*PolicyStatusResponse, error)
+	// WatchRevisions streams an event for every policy update, starting with
+	// the active revision.
+	WatchRevisions(*WatchRevisionsRequest, DecisionService_WatchRevisionsServer) error
+	mustEmbedUnimplementedDecisionServiceServer()
+}
+
+// UnimplementedDecisionServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedDecisionServiceServer struct {
+}
+
+func (UnimplementedDecisionServiceServer) Decide(context.Context, *DecisionRequest) (*DecisionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Decide not implemented")
+}
+func (UnimplementedDecisionServiceServer) DecideBatch(context.Context, *BatchDecisionRequest) (*BatchDecisionResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DecideBatch not implemented")
+}
+func (UnimplementedDecisionServiceServer) GetPolicyStatus(context.Context, *PolicyStatusRequest) (*PolicyStatusResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetPolicyStatus not implemented")
+}
+func (UnimplementedDecisionServiceServer) WatchRevisions(*WatchRevisionsRequest, DecisionService_WatchRevisionsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRevisions not implemented")
+}
+func (UnimplementedDecisionServiceServer) mustEmbedUnimplementedDecisionServiceServer() {}
+
+// UnsafeDecisionServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DecisionServiceServer will
+// result in compilation errors.
+type UnsafeDecisionServiceServer interface {
+	mustEmbedUnimplementedDecisionServiceServer()
+}
+
+func RegisterDecisionServiceServer(s grpc.ServiceRegistrar, srv DecisionServiceServer) {
+	s.RegisterService(&DecisionService_ServiceDesc, srv)
+}
+
+func _DecisionService_Decide_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DecisionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DecisionServiceServer).Decide(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DecisionService_Decide_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DecisionServiceServer).Decide(ctx, req.(*DecisionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DecisionService_DecideBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BatchDecisionRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DecisionServiceServer).DecideBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DecisionService_DecideBatch_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DecisionServiceServer).DecideBatch(ctx, req.(*BatchDecisionRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DecisionService_GetPolicyStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PolicyStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DecisionServiceServer).GetPolicyStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DecisionService_GetPolicyStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DecisionServiceServer).GetPolicyStatus(ctx, req.(*PolicyStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DecisionService_WatchRevisions_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRevisionsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DecisionServiceServer).WatchRevisions(m, &decisionServiceWatchRevisionsServer{stream})
+}
+
+type DecisionService_WatchRevisionsServer interface {
+	Send(*RevisionEvent) error
+	grpc.ServerStream
+}
+
+type decisionServiceWatchRevisionsServer struct {
+	grpc.ServerStream
+}
+
+func (x *decisionServiceWatchRevisionsServer) Send(m *RevisionEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// DecisionService_ServiceDesc is the grpc.ServiceDesc for DecisionService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DecisionService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "pdp.v1.DecisionService",
+	HandlerType: (*DecisionServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Decide",
+			Handler:    _DecisionService_Decide_Handler,
+		},
+		{
+			MethodName: "DecideBatch",
+			Handler:    _DecisionService_DecideBatch_Handler,
+		},
+		{
+			MethodName: "GetPolicyStatus",
+			Handler:    _DecisionService_GetPolicyStatus_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRevisions",
+			Handler:       _DecisionService_WatchRevisions_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pdp/v1/pdp.proto",
+}